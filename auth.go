@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+    // userContextKey is the gin context key holding the authenticated user's identity
+    userContextKey = "user"
+    // roleContextKey holds the token's role claim, empty for ordinary users
+    roleContextKey = "role"
+    roleAdmin      = "admin"
+)
+
+// authMiddleware rejects requests without a valid HS256 bearer token and stores its sub and role claims
+func authMiddleware(secret []byte) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        header := c.GetHeader("Authorization")
+        tokenString, found := strings.CutPrefix(header, "Bearer ")
+        if !found || tokenString == "" {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Missing bearer token")
+            loggerFrom(c).Warn("Missing bearer token")
+            return
+        }
+
+        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+            return secret, nil
+        }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+        if err != nil || !token.Valid {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Invalid token")
+            loggerFrom(c).Warn("Invalid token")
+            return
+        }
+
+        subject, err := token.Claims.GetSubject()
+        if err != nil || subject == "" {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Token has no subject")
+            loggerFrom(c).Warn("Token has no subject")
+            return
+        }
+
+        c.Set(userContextKey, normalizeName(subject))
+        if claims, ok := token.Claims.(jwt.MapClaims); ok {
+            if role, ok := claims["role"].(string); ok {
+                c.Set(roleContextKey, role)
+            }
+        }
+        c.Next()
+    }
+}
+
+// requireAdmin only lets through tokens carrying the admin role, it must run after authMiddleware
+func requireAdmin() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !isAdmin(c) {
+            respondError(c, http.StatusForbidden, codeForbidden, "Admin role required")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to use an admin route", c.GetString(userContextKey)))
+            return
+        }
+        c.Next()
+    }
+}
+
+// isAdmin reports whether the request's token carries the admin role
+func isAdmin(c *gin.Context) bool {
+    return c.GetString(roleContextKey) == roleAdmin
+}
+
+// authenticatedUser returns the identity stored by authMiddleware
+func authenticatedUser(c *gin.Context) (string, error) {
+    user := c.GetString(userContextKey)
+    if user == "" {
+        return "", errors.New("no authenticated user")
+    }
+    return user, nil
+}
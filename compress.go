@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipWriter holds the body back until it reaches minSize, then switches to gzip, smaller bodies go out as is
+type gzipWriter struct {
+    gin.ResponseWriter
+    minSize int
+    buf     []byte
+    gz      *gzip.Writer
+    decided bool
+}
+
+// start decides how the body goes out, compressing unless the handler already encoded it itself
+func (w *gzipWriter) start(compress bool) error {
+    w.decided = true
+    if compress && w.Header().Get("Content-Encoding") == "" {
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Header().Del("Content-Length")
+        w.gz = gzip.NewWriter(w.ResponseWriter)
+    }
+
+    buffered := w.buf
+    w.buf = nil
+    if len(buffered) == 0 {
+        return nil
+    }
+    _, err := w.write(buffered)
+    return err
+}
+
+func (w *gzipWriter) write(data []byte) (int, error) {
+    if w.gz != nil {
+        return w.gz.Write(data)
+    }
+    return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+    if w.decided {
+        return w.write(data)
+    }
+
+    w.buf = append(w.buf, data...)
+    if len(w.buf) >= w.minSize {
+        if err := w.start(true); err != nil {
+            return 0, err
+        }
+    }
+    return len(data), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+    return w.Write([]byte(s))
+}
+
+// Flush sends what has been written so far, a streamed body is compressed whatever its size
+func (w *gzipWriter) Flush() {
+    if !w.decided {
+        w.start(true)
+    }
+    if w.gz != nil {
+        w.gz.Flush()
+    }
+    w.ResponseWriter.Flush()
+}
+
+// finish writes out a body that never reached minSize and closes the gzip stream
+func (w *gzipWriter) finish() {
+    if !w.decided {
+        w.start(false)
+    }
+    if w.gz != nil {
+        w.gz.Close()
+    }
+}
+
+// gzipMiddleware compresses responses of at least minSize bytes for clients that accept gzip
+func gzipMiddleware(minSize int) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        // WebSocket upgrades hijack the connection, so there is no body to compress
+        if c.GetHeader("Upgrade") != "" {
+            c.Next()
+            return
+        }
+
+        // Added rather than set so an earlier Vary: Origin is kept
+        c.Writer.Header().Add("Vary", "Accept-Encoding")
+        if !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+            c.Next()
+            return
+        }
+
+        original := c.Writer
+        writer := &gzipWriter{ResponseWriter: original, minSize: minSize}
+        c.Writer = writer
+        c.Next()
+
+        writer.finish()
+        c.Writer = original
+    }
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+)
+
+// Config holds every setting read from the environment, loaded and validated once at startup
+type Config struct {
+    Environment string
+    LogFormat   string
+    LogLevel    string
+    GinMode     string
+    ListenAddr      string
+    TLSCertFile     string
+    TLSKeyFile      string
+    ShutdownTimeout time.Duration
+
+    MongoURI             string
+    MongoDatabase        string
+    MongoCollection      string
+    MongoConnectAttempts int
+    MongoConnectMaxDelay time.Duration
+    MongoMaxPoolSize     uint64
+    MongoMinPoolSize     uint64
+    MongoReadPreference  readpref.Mode
+
+    DBTimeout            time.Duration
+    MaxContentLength     int
+    LowercaseNames       bool
+    MessageRetention     time.Duration
+    SoftDeleteRetention  time.Duration
+    SchedulePollInterval time.Duration
+    DedupWindow          time.Duration
+    EditWindow           time.Duration
+    AllowSelfMessages    bool
+    RecipientQuota       int64
+    RecipientQuotaWindow time.Duration
+
+    GzipMinSize    int
+    MaxBodyBytes   int64
+    MaxImportBytes int64
+
+    JWTSecret      []byte
+    RateLimitRPS   float64
+    RateLimitBurst int
+    CORS           corsConfig
+
+    AnalyticsWebhookURL           string
+    AnalyticsBatchSize            int
+    AnalyticsFlushInterval        time.Duration
+    AnalyticsCheckpointCollection string
+
+    TracingEndpoint string
+    ServiceName     string
+
+    PresenceCollection      string
+    PresenceOnlineThreshold time.Duration
+}
+
+// loadConfig reads the configuration from the environment, returning an error naming the first malformed value
+func loadConfig() (Config, error) {
+    var err error
+    cfg := Config{
+        Environment:     getEnv("APP_ENV", "production"),
+        LogFormat:       getEnv("LOG_FORMAT", "json"),
+        LogLevel:        getEnv("LOG_LEVEL", ""),
+        ListenAddr:      listenAddr(),
+        TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+        TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+        MongoURI:        getEnv("MONGODB_URI", "mongodb://localhost:27017"),
+        MongoDatabase:   getEnv("MONGODB_DATABASE", "Golang"),
+        MongoCollection: getEnv("MONGODB_COLLECTION", "messages"),
+        JWTSecret:       []byte(getEnv("JWT_SECRET", "")),
+        CORS: corsConfig{
+            AllowedOrigins: splitList(getEnv("CORS_ALLOWED_ORIGINS", "http://localhost:3000")),
+            AllowedMethods: splitList(getEnv("CORS_ALLOWED_METHODS", "GET,POST,PUT,PATCH,DELETE,OPTIONS")),
+            AllowedHeaders: splitList(getEnv("CORS_ALLOWED_HEADERS", "Authorization,Content-Type,X-Request-ID,Idempotency-Key,X-Read-Preference")),
+        },
+        AnalyticsWebhookURL:           getEnv("ANALYTICS_WEBHOOK_URL", ""),
+        AnalyticsCheckpointCollection: getEnv("ANALYTICS_CHECKPOINT_COLLECTION", "checkpoints"),
+        TracingEndpoint:               getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+        ServiceName:                   getEnv("OTEL_SERVICE_NAME", "messages-api"),
+        PresenceCollection:            getEnv("PRESENCE_COLLECTION", "presence"),
+    }
+
+    // Logging and gin mode
+    if cfg.LogLevel != "" {
+        if _, err := zap.ParseAtomicLevel(cfg.LogLevel); err != nil {
+            return Config{}, fmt.Errorf("LOG_LEVEL: %s", err.Error())
+        }
+    }
+    cfg.GinMode = getEnv("GIN_MODE", "")
+    if cfg.GinMode == "" {
+        // Debug output is only wanted while developing
+        cfg.GinMode = gin.ReleaseMode
+        if cfg.Environment == "development" {
+            cfg.GinMode = gin.DebugMode
+        }
+    }
+    if cfg.GinMode != gin.DebugMode && cfg.GinMode != gin.ReleaseMode && cfg.GinMode != gin.TestMode {
+        return Config{}, fmt.Errorf("GIN_MODE must be debug, release or test")
+    }
+
+    // HTTPS is served only when both halves of the key pair are given
+    if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+        return Config{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    }
+
+    // How long in-flight requests get to finish on shutdown, matched to the orchestrator's grace period
+    cfg.ShutdownTimeout, err = time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "15s"))
+    if err != nil || cfg.ShutdownTimeout <= 0 {
+        return Config{}, fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration")
+    }
+
+    // Retry settings for databases that are still starting up
+    cfg.MongoConnectAttempts, err = strconv.Atoi(getEnv("MONGODB_CONNECT_ATTEMPTS", "5"))
+    if err != nil || cfg.MongoConnectAttempts < 1 {
+        return Config{}, fmt.Errorf("MONGODB_CONNECT_ATTEMPTS must be a positive integer")
+    }
+    cfg.MongoConnectMaxDelay, err = time.ParseDuration(getEnv("MONGODB_CONNECT_MAX_DELAY", "30s"))
+    if err != nil || cfg.MongoConnectMaxDelay <= 0 {
+        return Config{}, fmt.Errorf("MONGODB_CONNECT_MAX_DELAY must be a positive duration")
+    }
+
+    // Connection pool, the defaults match the driver's
+    cfg.MongoMaxPoolSize, err = strconv.ParseUint(getEnv("MONGODB_MAX_POOL_SIZE", "100"), 10, 64)
+    if err != nil || cfg.MongoMaxPoolSize < 1 {
+        return Config{}, fmt.Errorf("MONGODB_MAX_POOL_SIZE must be a positive integer")
+    }
+    cfg.MongoMinPoolSize, err = strconv.ParseUint(getEnv("MONGODB_MIN_POOL_SIZE", "0"), 10, 64)
+    if err != nil || cfg.MongoMinPoolSize > cfg.MongoMaxPoolSize {
+        return Config{}, fmt.Errorf("MONGODB_MIN_POOL_SIZE must be a non-negative integer no larger than MONGODB_MAX_POOL_SIZE")
+    }
+
+    // Replica set members to read from, handlers may override it per request
+    cfg.MongoReadPreference, err = readpref.ModeFromString(getEnv("MONGODB_READ_PREFERENCE", "primary"))
+    if err != nil {
+        return Config{}, fmt.Errorf("MONGODB_READ_PREFERENCE must be primary, primaryPreferred, secondary, secondaryPreferred or nearest")
+    }
+
+    // Handler limits
+    cfg.DBTimeout, err = time.ParseDuration(getEnv("DB_TIMEOUT", dbTimeout.String()))
+    if err != nil || cfg.DBTimeout <= 0 {
+        return Config{}, fmt.Errorf("DB_TIMEOUT must be a positive duration")
+    }
+    cfg.MaxContentLength, err = strconv.Atoi(getEnv("MAX_CONTENT_LENGTH", strconv.Itoa(maxContentLength)))
+    if err != nil || cfg.MaxContentLength < 1 {
+        return Config{}, fmt.Errorf("MAX_CONTENT_LENGTH must be a positive integer")
+    }
+    cfg.LowercaseNames, err = strconv.ParseBool(getEnv("LOWERCASE_NAMES", "false"))
+    if err != nil {
+        return Config{}, fmt.Errorf("LOWERCASE_NAMES must be a boolean")
+    }
+    cfg.MessageRetention, err = time.ParseDuration(getEnv("MESSAGE_RETENTION", "0s"))
+    if err != nil || cfg.MessageRetention < 0 {
+        return Config{}, fmt.Errorf("MESSAGE_RETENTION must be a non-negative duration")
+    }
+    cfg.SoftDeleteRetention, err = time.ParseDuration(getEnv("SOFT_DELETE_RETENTION", "720h"))
+    if err != nil || cfg.SoftDeleteRetention < 0 {
+        return Config{}, fmt.Errorf("SOFT_DELETE_RETENTION must be a non-negative duration")
+    }
+    cfg.SchedulePollInterval, err = time.ParseDuration(getEnv("SCHEDULE_POLL_INTERVAL", "10s"))
+    if err != nil || cfg.SchedulePollInterval <= 0 {
+        return Config{}, fmt.Errorf("SCHEDULE_POLL_INTERVAL must be a positive duration")
+    }
+
+    // Identical messages sent this close together are treated as a double submit, zero turns the check off
+    cfg.DedupWindow, err = time.ParseDuration(getEnv("DEDUP_WINDOW", "0s"))
+    if err != nil || cfg.DedupWindow < 0 {
+        return Config{}, fmt.Errorf("DEDUP_WINDOW must be a non-negative duration")
+    }
+
+    // Self-addressed messages usually come from a buggy client, unless notes to self are wanted
+    cfg.AllowSelfMessages, err = strconv.ParseBool(getEnv("ALLOW_SELF_MESSAGES", "false"))
+    if err != nil {
+        return Config{}, fmt.Errorf("ALLOW_SELF_MESSAGES must be a boolean")
+    }
+
+    // Per sender and recipient pair, on top of the per-IP rate limit
+    cfg.RecipientQuota, err = strconv.ParseInt(getEnv("RECIPIENT_QUOTA", "0"), 10, 64)
+    if err != nil || cfg.RecipientQuota < 0 {
+        return Config{}, fmt.Errorf("RECIPIENT_QUOTA must be a non-negative integer")
+    }
+    cfg.RecipientQuotaWindow, err = time.ParseDuration(getEnv("RECIPIENT_QUOTA_WINDOW", "1h"))
+    if err != nil || cfg.RecipientQuotaWindow <= 0 {
+        return Config{}, fmt.Errorf("RECIPIENT_QUOTA_WINDOW must be a positive duration")
+    }
+
+    // Sent messages can only be edited this long, zero (the default) allows edits at any time
+    cfg.EditWindow, err = time.ParseDuration(getEnv("EDIT_WINDOW", "0s"))
+    if err != nil || cfg.EditWindow < 0 {
+        return Config{}, fmt.Errorf("EDIT_WINDOW must be a non-negative duration")
+    }
+
+    // Responses smaller than this aren't worth compressing
+    cfg.GzipMinSize, err = strconv.Atoi(getEnv("GZIP_MIN_SIZE", "1024"))
+    if err != nil || cfg.GzipMinSize < 0 {
+        return Config{}, fmt.Errorf("GZIP_MIN_SIZE must be a non-negative integer")
+    }
+
+    // Bodies are read into memory before validation, so they are capped
+    cfg.MaxBodyBytes, err = strconv.ParseInt(getEnv("MAX_BODY_BYTES", "1048576"), 10, 64)
+    if err != nil || cfg.MaxBodyBytes < 1 {
+        return Config{}, fmt.Errorf("MAX_BODY_BYTES must be a positive integer")
+    }
+    cfg.MaxImportBytes, err = strconv.ParseInt(getEnv("MAX_IMPORT_BYTES", "104857600"), 10, 64)
+    if err != nil || cfg.MaxImportBytes < 1 {
+        return Config{}, fmt.Errorf("MAX_IMPORT_BYTES must be a positive integer")
+    }
+
+    // Browsers cache preflights for this long, zero makes them send one before every request
+    cfg.CORS.MaxAge, err = time.ParseDuration(getEnv("CORS_MAX_AGE", "600s"))
+    if err != nil || cfg.CORS.MaxAge < 0 {
+        return Config{}, fmt.Errorf("CORS_MAX_AGE must be a non-negative duration")
+    }
+
+    // Authentication and rate limiting
+    if len(cfg.JWTSecret) == 0 {
+        return Config{}, fmt.Errorf("JWT_SECRET must be set")
+    }
+    cfg.RateLimitRPS, err = strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "10"), 64)
+    if err != nil || cfg.RateLimitRPS <= 0 {
+        return Config{}, fmt.Errorf("RATE_LIMIT_RPS must be a positive number")
+    }
+    cfg.RateLimitBurst, err = strconv.Atoi(getEnv("RATE_LIMIT_BURST", "20"))
+    if err != nil || cfg.RateLimitBurst <= 0 {
+        return Config{}, fmt.Errorf("RATE_LIMIT_BURST must be a positive integer")
+    }
+
+    // Users count as online for this long after their last heartbeat
+    cfg.PresenceOnlineThreshold, err = time.ParseDuration(getEnv("PRESENCE_ONLINE_THRESHOLD", "60s"))
+    if err != nil || cfg.PresenceOnlineThreshold <= 0 {
+        return Config{}, fmt.Errorf("PRESENCE_ONLINE_THRESHOLD must be a positive duration")
+    }
+
+    // Analytics webhook, only validated when enabled
+    if cfg.AnalyticsWebhookURL != "" {
+        cfg.AnalyticsBatchSize, err = strconv.Atoi(getEnv("ANALYTICS_BATCH_SIZE", "100"))
+        if err != nil || cfg.AnalyticsBatchSize < 1 {
+            return Config{}, fmt.Errorf("ANALYTICS_BATCH_SIZE must be a positive integer")
+        }
+        cfg.AnalyticsFlushInterval, err = time.ParseDuration(getEnv("ANALYTICS_FLUSH_INTERVAL", "5s"))
+        if err != nil || cfg.AnalyticsFlushInterval <= 0 {
+            return Config{}, fmt.Errorf("ANALYTICS_FLUSH_INTERVAL must be a positive duration")
+        }
+    }
+
+    return cfg, nil
+}
+
+// getEnv returns the value of the environment variable or the fallback when unset
+func getEnv(key string, fallback string) string {
+    if value, ok := os.LookupEnv(key); ok && value != "" {
+        return value
+    }
+    return fallback
+}
+
+// listenAddr returns LISTEN_ADDR, or binds all interfaces on PORT for platforms that only set that
+func listenAddr() string {
+    if addr := getEnv("LISTEN_ADDR", ""); addr != "" {
+        return addr
+    }
+    if port := getEnv("PORT", ""); port != "" {
+        return "0.0.0.0:" + port
+    }
+    return "0.0.0.0:8080"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error codes are stable so clients can switch on them instead of the English message
+const (
+    codeInvalidID         = "INVALID_ID"
+    codeInvalidQuery      = "INVALID_QUERY"
+    codeInvalidBody       = "INVALID_BODY"
+    codeUnsupportedMedia  = "UNSUPPORTED_MEDIA_TYPE"
+    codePayloadTooLarge   = "PAYLOAD_TOO_LARGE"
+    codeValidation        = "VALIDATION_FAILED"
+    codeMessageNotFound   = "MESSAGE_NOT_FOUND"
+    codeRouteNotFound     = "ROUTE_NOT_FOUND"
+    codeUnauthorized      = "UNAUTHORIZED"
+    codeForbidden         = "FORBIDDEN"
+    codeInvalidTransition = "INVALID_STATUS_TRANSITION"
+    codeVersionConflict   = "VERSION_CONFLICT"
+    codeRateLimited       = "RATE_LIMITED"
+    codeDBError           = "DB_ERROR"
+    codeDBUnavailable     = "DB_UNAVAILABLE"
+    codeInternal          = "INTERNAL_ERROR"
+    codeEditWindowExpired = "EDIT_WINDOW_EXPIRED"
+)
+
+// ErrorResponse documents the shape of every error response
+type ErrorResponse struct {
+    Error ErrorBody `json:"error"`
+}
+
+// ErrorBody carries the stable error code and a human-readable message
+type ErrorBody struct {
+    Code      string `json:"code" example:"MESSAGE_NOT_FOUND"`
+    Message   string `json:"message" example:"Message not found"`
+    // RequestID and TraceID are only set on 5xx responses
+    RequestID string `json:"requestId,omitempty" example:"4c92926376ebadff17b3090259911eb2"`
+    TraceID   string `json:"traceId,omitempty" example:"0af7651916cd43dd8448eb211c80319c"`
+}
+
+// respondError aborts the request with {"error":{"code":...,"message":...}}, merging in any details
+func respondError(c *gin.Context, status int, code string, message string, details ...gin.H) {
+    body := gin.H{"code": code, "message": message}
+    for _, detail := range details {
+        for key, value := range detail {
+            body[key] = value
+        }
+    }
+
+    // Server errors carry the IDs the logs are keyed on, so a reported failure can be traced back
+    if status >= http.StatusInternalServerError {
+        body["requestId"] = c.GetString(requestIDContextKey)
+        if spanContext := trace.SpanContextFromContext(c.Request.Context()); spanContext.HasTraceID() {
+            body["traceId"] = spanContext.TraceID().String()
+        }
+    }
+    c.AbortWithStatusJSON(status, gin.H{"error": body})
+}
+
+// routeNotFound answers unknown routes with the same error shape as the handlers
+func routeNotFound(c *gin.Context) {
+    respondError(c, http.StatusNotFound, codeRouteNotFound, "Route not found")
+}
+
+// unknownFieldPrefix starts the error encoding/json returns for a field rejected by DisallowUnknownFields, it has no error type
+const unknownFieldPrefix = "json: unknown field "
+
+// respondBindError explains why a JSON request body could not be decoded
+func respondBindError(c *gin.Context, err error) {
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    var maxBytesErr *http.MaxBytesError
+
+    switch {
+    case errors.As(err, &maxBytesErr):
+        respondPayloadTooLarge(c, maxBytesErr.Limit)
+    case errors.As(err, &syntaxErr):
+        respondError(c, http.StatusBadRequest, codeInvalidBody, "malformed JSON", gin.H{"offset": syntaxErr.Offset})
+        loggerFrom(c).Warn(fmt.Sprintf("Malformed JSON at offset %d", syntaxErr.Offset))
+    case errors.As(err, &typeErr):
+        message := fmt.Sprintf("%s must be of type %s", typeErr.Field, typeErr.Type)
+        respondError(c, http.StatusBadRequest, codeInvalidBody, message, gin.H{"field": typeErr.Field, "offset": typeErr.Offset})
+        loggerFrom(c).Warn("Invalid JSON field type: " + message)
+    case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+        field := strings.Trim(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`)
+        respondError(c, http.StatusBadRequest, codeInvalidBody, "unknown field "+field, gin.H{"field": field})
+        loggerFrom(c).Warn("Unknown JSON field: " + field)
+    case errors.Is(err, io.EOF):
+        respondError(c, http.StatusBadRequest, codeInvalidBody, "request body is empty")
+        loggerFrom(c).Warn("Empty request body")
+    case errors.Is(err, io.ErrUnexpectedEOF):
+        respondError(c, http.StatusBadRequest, codeInvalidBody, "malformed JSON: unexpected end of input")
+        loggerFrom(c).Warn("Malformed JSON: unexpected end of input")
+    default:
+        respondError(c, http.StatusBadRequest, codeInvalidBody, "Failed to decode request body")
+        loggerFrom(c).Warn("Failed to decode request body")
+    }
+}
+
+// respondPayloadTooLarge answers 413 for a body over the limit set by limitBody
+func respondPayloadTooLarge(c *gin.Context, limit int64) {
+    respondError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("request body must not exceed %d bytes", limit), gin.H{"limit": limit})
+    loggerFrom(c).Warn("Request body too large")
+}
+
+// dbRetryAfterSeconds is the Retry-After hint sent when the database is temporarily unreachable
+const dbRetryAfterSeconds = "5"
+
+// isTransientDBError reports whether a driver error is likely to succeed on retry (network, timeout, retryable labels)
+func isTransientDBError(err error) bool {
+    if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, mongo.ErrClientDisconnected) {
+        return true
+    }
+    if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+        return true
+    }
+
+    var labeled mongo.LabeledError
+    if errors.As(err, &labeled) {
+        return labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError")
+    }
+    return false
+}
+
+// respondDBError answers a failed database operation with 503 + Retry-After when retrying may help, 500 otherwise
+func respondDBError(c *gin.Context, err error, message string) {
+    if isTransientDBError(err) {
+        c.Header("Retry-After", dbRetryAfterSeconds)
+        respondError(c, http.StatusServiceUnavailable, codeDBUnavailable, "Database temporarily unavailable")
+        loggerFrom(c).Warn(message + ": " + err.Error())
+        return
+    }
+
+    respondError(c, http.StatusInternalServerError, codeDBError, message)
+    loggerFrom(c).Error(message + ": " + err.Error())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventBuffer is how many published messages an event stream holds for a slow client before dropping them
+const eventBuffer = 16
+
+// Hub is an in-process pub/sub that fans out sent messages to every subscriber
+type Hub struct {
+    mu          sync.RWMutex
+    subscribers map[int]chan Message
+    nextID      int
+}
+
+func newHub() *Hub {
+    return &Hub{subscribers: map[int]chan Message{}}
+}
+
+// Subscribe returns a channel of published messages and a function that ends the subscription
+func (h *Hub) Subscribe(buffer int) (<-chan Message, func()) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    id := h.nextID
+    h.nextID++
+    ch := make(chan Message, buffer)
+    h.subscribers[id] = ch
+
+    var once sync.Once
+    unsubscribe := func() {
+        once.Do(func() {
+            h.mu.Lock()
+            defer h.mu.Unlock()
+            delete(h.subscribers, id)
+            close(ch)
+        })
+    }
+    return ch, unsubscribe
+}
+
+// Publish delivers the message to every subscriber without blocking on slow ones
+func (h *Hub) Publish(message Message) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    for _, ch := range h.subscribers {
+        select {
+        case ch <- message:
+        default:
+            logger.Warn("Dropping published message for slow subscriber")
+        }
+    }
+}
+
+// curl -N -H "Authorization: Bearer $TOKEN" http://localhost:8080/events
+// @Summary      Stream messages sent to the authenticated user
+// @Description  Server-sent events, one "message" event per message as it is sent or delivered
+// @Tags         messages
+// @Produce      text/event-stream
+// @Success      200  {object}  Message
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Security     BearerAuth
+// @Router       /events [get]
+func streamEvents(hub *Hub) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        messages, unsubscribe := hub.Subscribe(eventBuffer)
+        defer unsubscribe()
+
+        // The headers go out straight away so the client knows it is subscribed before the first message
+        c.Header("Content-Type", "text/event-stream")
+        c.Header("Cache-Control", "no-cache")
+        c.Status(http.StatusOK)
+        c.Writer.Flush()
+        loggerFrom(c).Info("Event stream opened for " + user)
+
+        // Only messages addressed to the user are streamed, until the client goes away
+        c.Stream(func(w io.Writer) bool {
+            select {
+            case <-c.Request.Context().Done():
+                return false
+            case message, ok := <-messages:
+                if !ok {
+                    return false
+                }
+                if message.Recipient == user {
+                    c.SSEvent("message", message)
+                }
+                return true
+            }
+        })
+        loggerFrom(c).Info("Event stream closed for " + user)
+    }
+}
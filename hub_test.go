@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHubPublishReachesSubscribers(t *testing.T) {
+    hub := newHub()
+    first, unsubscribeFirst := hub.Subscribe(1)
+    defer unsubscribeFirst()
+    second, unsubscribeSecond := hub.Subscribe(1)
+    defer unsubscribeSecond()
+
+    hub.Publish(Message{Sender: "Bob", Recipient: "Alice", Content: "Hello"})
+
+    for _, messages := range []<-chan Message{first, second} {
+        select {
+        case message := <-messages:
+            if message.Recipient != "Alice" || message.Content != "Hello" {
+                t.Fatalf("got %+v, want the published message", message)
+            }
+        case <-time.After(time.Second):
+            t.Fatal("published message was not received")
+        }
+    }
+}
+
+func TestHubUnsubscribeClosesChannel(t *testing.T) {
+    hub := newHub()
+    messages, unsubscribe := hub.Subscribe(1)
+    unsubscribe()
+    unsubscribe()
+
+    // Nothing is delivered once unsubscribed, the channel is just closed
+    hub.Publish(Message{Sender: "Bob", Recipient: "Alice", Content: "Hello"})
+    if message, ok := <-messages; ok {
+        t.Fatalf("got %+v after unsubscribing", message)
+    }
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const testJWTSecret = "integration-secret"
+
+// testAPI drives the real router against a MongoDB container
+type testAPI struct {
+    router     *gin.Engine
+    collection *mongo.Collection
+}
+
+// setupIntegration starts MongoDB in a container and builds the router against it, skipping without Docker
+func setupIntegration(t *testing.T) *testAPI {
+    testcontainers.SkipIfProviderIsNotHealthy(t)
+    ctx := context.Background()
+
+    container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+        ContainerRequest: testcontainers.ContainerRequest{
+            Image:        "mongo:6",
+            ExposedPorts: []string{"27017/tcp"},
+            WaitingFor:   wait.ForListeningPort("27017/tcp"),
+        },
+        Started: true,
+    })
+    if err != nil {
+        t.Fatalf("starting MongoDB container: %v", err)
+    }
+    t.Cleanup(func() { container.Terminate(ctx) })
+
+    uri, err := container.PortEndpoint(ctx, "27017/tcp", "mongodb")
+    if err != nil {
+        t.Fatalf("reading MongoDB endpoint: %v", err)
+    }
+
+    // The configuration is read like in production, with the rate limit out of the way
+    t.Setenv("MONGODB_URI", uri)
+    t.Setenv("MONGODB_DATABASE", "integration")
+    t.Setenv("JWT_SECRET", testJWTSecret)
+    t.Setenv("RATE_LIMIT_RPS", "10000")
+    t.Setenv("RATE_LIMIT_BURST", "10000")
+    t.Setenv("GIN_MODE", gin.TestMode)
+    cfg, err := loadConfig()
+    if err != nil {
+        t.Fatalf("loading config: %v", err)
+    }
+    logger = zap.NewNop()
+    gin.SetMode(cfg.GinMode)
+
+    client, collection, err := setupMongoDB(cfg)
+    if err != nil {
+        t.Fatalf("connecting to MongoDB: %v", err)
+    }
+    t.Cleanup(func() { client.Disconnect(ctx) })
+    if err := ensureIndexes(ctx, collection); err != nil {
+        t.Fatalf("ensuring indexes: %v", err)
+    }
+
+    presence := collection.Database().Collection(cfg.PresenceCollection)
+    router := setupRouter(cfg, client, collection, presence, newHub(), newWSHub())
+    return &testAPI{router: router, collection: collection}
+}
+
+// reset empties the collection so every test starts from scratch
+func (a *testAPI) reset(t *testing.T) {
+    if _, err := a.collection.DeleteMany(context.Background(), bson.M{}); err != nil {
+        t.Fatalf("clearing messages: %v", err)
+    }
+}
+
+// do sends the request as user, body is encoded as JSON unless nil, and an empty user sends no token
+func (a *testAPI) do(t *testing.T, method string, path string, user string, body interface{}) *httptest.ResponseRecorder {
+    var reader *bytes.Reader
+    if body != nil {
+        encoded, err := json.Marshal(body)
+        if err != nil {
+            t.Fatalf("encoding request body: %v", err)
+        }
+        reader = bytes.NewReader(encoded)
+    } else {
+        reader = bytes.NewReader(nil)
+    }
+
+    req := httptest.NewRequest(method, path, reader)
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if user != "" {
+        token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": user}).SignedString([]byte(testJWTSecret))
+        if err != nil {
+            t.Fatalf("signing token: %v", err)
+        }
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    rec := httptest.NewRecorder()
+    a.router.ServeHTTP(rec, req)
+    return rec
+}
+
+// send creates a message from sender and fails the test unless it is stored
+func (a *testAPI) send(t *testing.T, sender string, body gin.H) Message {
+    rec := a.do(t, http.MethodPost, "/messages", sender, body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("sending message: got %d: %s", rec.Code, rec.Body.String())
+    }
+    var message Message
+    decodeBody(t, rec, &message)
+    return message
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+    if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+        t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+    }
+}
+
+// expectError checks the status and the stable error code of an error response
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+    if rec.Code != status {
+        t.Fatalf("got status %d, want %d: %s", rec.Code, status, rec.Body.String())
+    }
+    var body ErrorResponse
+    decodeBody(t, rec, &body)
+    if body.Error.Code != code {
+        t.Fatalf("got error code %q, want %q", body.Error.Code, code)
+    }
+}
+
+func TestIntegration(t *testing.T) {
+    api := setupIntegration(t)
+
+    // The client must keep working once the connect phase of setupMongoDB is over, not just during it
+    t.Run("requests a few seconds after startup", func(t *testing.T) {
+        time.Sleep(3 * time.Second)
+        if rec := api.do(t, http.MethodGet, "/health", "", nil); rec.Code != http.StatusOK {
+            t.Fatalf("health check: got %d: %s", rec.Code, rec.Body.String())
+        }
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Still connected"})
+        if rec := api.do(t, http.MethodGet, "/messages/"+message.ID.Hex(), "Alice", nil); rec.Code != http.StatusOK {
+            t.Fatalf("reading message: got %d: %s", rec.Code, rec.Body.String())
+        }
+    })
+
+    t.Run("send message", func(t *testing.T) {
+        api.reset(t)
+        tests := []struct {
+            name   string
+            user   string
+            body   interface{}
+            status int
+            code   string
+        }{
+            {"valid", "Bob", gin.H{"recipient": "Alice", "content": "Hello, Alice!"}, http.StatusCreated, ""},
+            {"sender defaults to the token", "Bob", gin.H{"recipient": "Alice", "sender": "Bob", "content": "Hi"}, http.StatusCreated, ""},
+            {"missing content", "Bob", gin.H{"recipient": "Alice"}, http.StatusBadRequest, codeValidation},
+            {"missing recipient", "Bob", gin.H{"content": "Hi"}, http.StatusBadRequest, codeValidation},
+            {"addressed to the sender", "Bob", gin.H{"recipient": "Bob", "content": "Note to self"}, http.StatusBadRequest, codeValidation},
+            {"sending as someone else", "Bob", gin.H{"recipient": "Alice", "sender": "Carol", "content": "Hi"}, http.StatusForbidden, codeForbidden},
+            {"wrong field type", "Bob", gin.H{"recipient": 42, "content": "Hi"}, http.StatusBadRequest, codeInvalidBody},
+            {"no token", "", gin.H{"recipient": "Alice", "content": "Hi"}, http.StatusUnauthorized, codeUnauthorized},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodPost, "/messages", tt.user, tt.body)
+                if tt.code != "" {
+                    expectError(t, rec, tt.status, tt.code)
+                    return
+                }
+                if rec.Code != tt.status {
+                    t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+                }
+                var message Message
+                decodeBody(t, rec, &message)
+                if rec.Header().Get("Location") != "/messages/"+message.ID.Hex() {
+                    t.Fatalf("got Location %q for message %s", rec.Header().Get("Location"), message.ID.Hex())
+                }
+                if message.Sender != tt.user || message.Status != statusSent || message.Read {
+                    t.Fatalf("unexpected stored message: %+v", message)
+                }
+            })
+        }
+    })
+
+    t.Run("send message ignores server-only fields", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{
+            "recipient": "Alice",
+            "content":   "Hello",
+            "read":      true,
+            "draft":     true,
+            "version":   7,
+            "history":   []gin.H{{"content": "forged"}},
+            "deletedAt": "2000-01-01T00:00:00Z",
+            "updatedAt": "2000-01-01T00:00:00Z",
+        })
+        if message.Read || message.Draft || message.Version != 0 || len(message.History) != 0 || message.DeletedAt != nil || !message.UpdatedAt.IsZero() {
+            t.Fatalf("client-supplied fields were stored: %+v", message)
+        }
+        if rec := api.do(t, http.MethodGet, "/messages/"+message.ID.Hex(), "Alice", nil); rec.Code != http.StatusOK {
+            t.Fatalf("reading the message: got %d", rec.Code)
+        }
+    })
+
+    t.Run("get message", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello"})
+        deleted := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Gone"})
+        api.do(t, http.MethodDelete, "/messages/"+deleted.ID.Hex(), "Bob", nil)
+
+        tests := []struct {
+            name   string
+            path   string
+            status int
+            code   string
+        }{
+            {"existing", "/messages/" + message.ID.Hex(), http.StatusOK, ""},
+            {"unknown", "/messages/64bd837566b7829eaa7ea650", http.StatusNotFound, codeMessageNotFound},
+            {"soft-deleted", "/messages/" + deleted.ID.Hex(), http.StatusNotFound, codeMessageNotFound},
+            {"invalid ID", "/messages/not-an-id", http.StatusBadRequest, codeInvalidID},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodGet, tt.path, "Alice", nil)
+                if tt.code != "" {
+                    expectError(t, rec, tt.status, tt.code)
+                    return
+                }
+                var fetched Message
+                decodeBody(t, rec, &fetched)
+                if rec.Code != tt.status || fetched.ID != message.ID || fetched.Content != "Hello" {
+                    t.Fatalf("got %d %+v", rec.Code, fetched)
+                }
+            })
+        }
+    })
+
+    t.Run("message exists", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello"})
+        if rec := api.do(t, http.MethodHead, "/messages/"+message.ID.Hex(), "Alice", nil); rec.Code != http.StatusOK {
+            t.Fatalf("existing message: got %d", rec.Code)
+        }
+        if rec := api.do(t, http.MethodHead, "/messages/64bd837566b7829eaa7ea650", "Alice", nil); rec.Code != http.StatusNotFound {
+            t.Fatalf("unknown message: got %d", rec.Code)
+        }
+    })
+
+    t.Run("list messages", func(t *testing.T) {
+        api.reset(t)
+        api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "one"})
+        api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "two"})
+        api.send(t, "Carol", gin.H{"recipient": "Dave", "content": "three"})
+
+        tests := []struct {
+            name  string
+            query string
+            count int
+        }{
+            {"everything", "", 3},
+            {"by recipient", "?recipient=Alice", 2},
+            {"by sender", "?sender=Carol", 1},
+            {"by sender prefix", "?senderContains=ca&match=prefix", 1},
+            {"first page", "?limit=2", 2},
+            {"past the end", "?limit=2&offset=4", 0},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodGet, "/messages"+tt.query, "Alice", nil)
+                var messages []Message
+                decodeBody(t, rec, &messages)
+                if rec.Code != http.StatusOK || len(messages) != tt.count {
+                    t.Fatalf("got %d with %d messages, want %d", rec.Code, len(messages), tt.count)
+                }
+            })
+        }
+
+        t.Run("envelope", func(t *testing.T) {
+            rec := api.do(t, http.MethodGet, "/messages?envelope=true&limit=1", "Alice", nil)
+            var page struct {
+                Data  []Message `json:"data"`
+                Total int64     `json:"total"`
+            }
+            decodeBody(t, rec, &page)
+            if rec.Code != http.StatusOK || len(page.Data) != 1 || page.Total != 3 {
+                t.Fatalf("got %d %+v", rec.Code, page)
+            }
+        })
+
+        t.Run("invalid limit", func(t *testing.T) {
+            expectError(t, api.do(t, http.MethodGet, "/messages?limit=0", "Alice", nil), http.StatusBadRequest, codeInvalidQuery)
+        })
+
+        t.Run("count", func(t *testing.T) {
+            rec := api.do(t, http.MethodGet, "/messages/count?recipient=Alice", "Alice", nil)
+            var body struct {
+                Count int64 `json:"count"`
+            }
+            decodeBody(t, rec, &body)
+            if rec.Code != http.StatusOK || body.Count != 2 {
+                t.Fatalf("got %d %+v", rec.Code, body)
+            }
+        })
+    })
+
+    t.Run("update message", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello", "labels": []string{"work"}})
+
+        tests := []struct {
+            name   string
+            id     string
+            body   interface{}
+            status int
+            code   string
+        }{
+            {"content", message.ID.Hex(), gin.H{"content": "Edited", "version": 0}, http.StatusOK, ""},
+            {"stale version", message.ID.Hex(), gin.H{"content": "Again", "version": 0}, http.StatusConflict, codeVersionConflict},
+            {"no fields", message.ID.Hex(), gin.H{}, http.StatusBadRequest, codeValidation},
+            {"changing the sender", message.ID.Hex(), gin.H{"sender": "Carol"}, http.StatusBadRequest, codeValidation},
+            {"addressed to the sender", message.ID.Hex(), gin.H{"recipient": "Bob"}, http.StatusBadRequest, codeValidation},
+            {"unknown", "64bd837566b7829eaa7ea650", gin.H{"content": "Edited"}, http.StatusNotFound, codeMessageNotFound},
+            {"invalid ID", "not-an-id", gin.H{"content": "Edited"}, http.StatusBadRequest, codeInvalidID},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodPatch, "/messages/"+tt.id, "Bob", tt.body)
+                if tt.code != "" {
+                    expectError(t, rec, tt.status, tt.code)
+                    return
+                }
+                if rec.Code != tt.status {
+                    t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+                }
+            })
+        }
+
+        // A partial update must leave the fields it doesn't mention alone, and the sender can't be changed at all
+        rec := api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex(), "Bob", gin.H{"sender": "Carol", "labels": []string{"work", "home"}})
+        if rec.Code != http.StatusOK {
+            t.Fatalf("patching with a sender: got %d: %s", rec.Code, rec.Body.String())
+        }
+        var updated Message
+        decodeBody(t, api.do(t, http.MethodGet, "/messages/"+message.ID.Hex(), "Bob", nil), &updated)
+        if updated.Sender != "Bob" || updated.Content != "Edited" || updated.Recipient != "Alice" || len(updated.Labels) != 2 || updated.Version != 2 {
+            t.Fatalf("unexpected message after update: %+v", updated)
+        }
+
+        var history []MessageVersion
+        rec = api.do(t, http.MethodGet, "/messages/"+message.ID.Hex()+"/history", "Bob", nil)
+        decodeBody(t, rec, &history)
+        if rec.Code != http.StatusOK || len(history) != 2 || history[1].Content != "Hello" || history[0].Sender != "Bob" {
+            t.Fatalf("got %d %+v", rec.Code, history)
+        }
+    })
+
+    t.Run("edit content and recipient", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello"})
+
+        rec := api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex()+"/content", "Bob", gin.H{"content": "Edited"})
+        var edited Message
+        decodeBody(t, rec, &edited)
+        if rec.Code != http.StatusOK || edited.Content != "Edited" {
+            t.Fatalf("content edit: got %d %+v", rec.Code, edited)
+        }
+
+        rec = api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex()+"/recipient", "Bob", gin.H{"recipient": "Carol"})
+        decodeBody(t, rec, &edited)
+        if rec.Code != http.StatusOK || edited.Recipient != "Carol" {
+            t.Fatalf("recipient edit: got %d %+v", rec.Code, edited)
+        }
+
+        expectError(t, api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex()+"/recipient", "Bob", gin.H{"recipient": "Bob"}), http.StatusBadRequest, codeValidation)
+        expectError(t, api.do(t, http.MethodPatch, "/messages/64bd837566b7829eaa7ea650/content", "Bob", gin.H{"content": "Edited"}), http.StatusNotFound, codeMessageNotFound)
+
+        // Once the edit window has passed neither the content nor the recipient can change
+        defer func(window time.Duration) { editWindow = window }(editWindow)
+        editWindow = time.Minute
+        if _, err := api.collection.UpdateByID(context.Background(), message.ID, bson.M{"$set": bson.M{"timestamp": time.Now().Add(-time.Hour)}}); err != nil {
+            t.Fatalf("backdating message: %v", err)
+        }
+        expectError(t, api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex()+"/content", "Bob", gin.H{"content": "Too late"}), http.StatusForbidden, codeEditWindowExpired)
+        expectError(t, api.do(t, http.MethodPatch, "/messages/"+message.ID.Hex()+"/recipient", "Bob", gin.H{"recipient": "Dave"}), http.StatusForbidden, codeEditWindowExpired)
+    })
+
+    t.Run("replace message", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello"})
+
+        tests := []struct {
+            name   string
+            id     string
+            body   interface{}
+            status int
+            code   string
+        }{
+            {"complete", message.ID.Hex(), gin.H{"recipient": "Carol", "content": "Replaced", "status": "bogus"}, http.StatusOK, ""},
+            {"missing content", message.ID.Hex(), gin.H{"recipient": "Carol"}, http.StatusBadRequest, codeValidation},
+            {"unknown", "64bd837566b7829eaa7ea650", gin.H{"recipient": "Carol", "content": "Replaced"}, http.StatusNotFound, codeMessageNotFound},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodPut, "/messages/"+tt.id, "Bob", tt.body)
+                if tt.code != "" {
+                    expectError(t, rec, tt.status, tt.code)
+                    return
+                }
+                if rec.Code != tt.status {
+                    t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+                }
+            })
+        }
+
+        // The creation timestamp and status survive the replacement
+        var replaced Message
+        decodeBody(t, api.do(t, http.MethodGet, "/messages/"+message.ID.Hex(), "Bob", nil), &replaced)
+        if replaced.Content != "Replaced" || replaced.Recipient != "Carol" || replaced.Status != statusSent || !replaced.Timestamp.Equal(message.Timestamp.Truncate(time.Millisecond)) {
+            t.Fatalf("unexpected message after replace: %+v", replaced)
+        }
+    })
+
+    t.Run("delete message", func(t *testing.T) {
+        api.reset(t)
+        soft := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Soft"})
+        hard := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hard"})
+
+        tests := []struct {
+            name   string
+            path   string
+            status int
+            code   string
+        }{
+            {"soft", "/messages/" + soft.ID.Hex(), http.StatusOK, ""},
+            {"already deleted", "/messages/" + soft.ID.Hex(), http.StatusNotFound, codeMessageNotFound},
+            {"hard", "/messages/" + hard.ID.Hex() + "?hard=true", http.StatusOK, ""},
+            {"unknown", "/messages/64bd837566b7829eaa7ea650", http.StatusNotFound, codeMessageNotFound},
+            {"invalid ID", "/messages/not-an-id", http.StatusBadRequest, codeInvalidID},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodDelete, tt.path, "Bob", nil)
+                if tt.code != "" {
+                    expectError(t, rec, tt.status, tt.code)
+                    return
+                }
+                if rec.Code != tt.status {
+                    t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+                }
+            })
+        }
+
+        // The soft-deleted message is kept, the hard-deleted one is gone
+        remaining, err := api.collection.CountDocuments(context.Background(), bson.M{})
+        if err != nil || remaining != 1 {
+            t.Fatalf("got %d stored messages (%v), want 1", remaining, err)
+        }
+    })
+
+    t.Run("status and read", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hello"})
+        path := "/messages/" + message.ID.Hex()
+
+        tests := []struct {
+            name   string
+            status string
+            want   int
+            code   string
+        }{
+            {"sent to delivered", statusDelivered, http.StatusOK, ""},
+            {"delivered to failed", statusFailed, http.StatusConflict, codeInvalidTransition},
+            {"unknown status", "lost", http.StatusBadRequest, codeValidation},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodPatch, path+"/status", "Alice", gin.H{"status": tt.status})
+                if tt.code != "" {
+                    expectError(t, rec, tt.want, tt.code)
+                    return
+                }
+                if rec.Code != tt.want {
+                    t.Fatalf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+                }
+            })
+        }
+
+        expectError(t, api.do(t, http.MethodPost, path+"/read", "Carol", nil), http.StatusForbidden, codeForbidden)
+        if rec := api.do(t, http.MethodPost, path+"/read", "Alice", nil); rec.Code != http.StatusOK {
+            t.Fatalf("mark read: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodPost, "/messages/64bd837566b7829eaa7ea650/read", "Alice", nil), http.StatusNotFound, codeMessageNotFound)
+
+        // A failed message has to be resent before it can be read
+        failed := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Lost"})
+        if rec := api.do(t, http.MethodPatch, "/messages/"+failed.ID.Hex()+"/status", "Alice", gin.H{"status": statusFailed}); rec.Code != http.StatusOK {
+            t.Fatalf("failing message: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodPost, "/messages/"+failed.ID.Hex()+"/read", "Alice", nil), http.StatusConflict, codeInvalidTransition)
+
+        var body struct {
+            Count int64 `json:"count"`
+        }
+        decodeBody(t, api.do(t, http.MethodGet, "/users/Alice/unread-count", "Alice", nil), &body)
+        if body.Count != 1 {
+            t.Fatalf("got %d unread messages, want 1", body.Count)
+        }
+    })
+
+    t.Run("bulk send and batch get", func(t *testing.T) {
+        api.reset(t)
+        rec := api.do(t, http.MethodPost, "/messages/bulk", "Bob", []gin.H{
+            {"recipient": "Alice", "content": "one", "forwardedFrom": "64bd837566b7829eaa7ea650", "read": true},
+            {"recipient": "Carol", "content": "two", "deliverAt": time.Now().Add(time.Hour)},
+        })
+        var inserted struct {
+            InsertedIDs []string `json:"insertedIds"`
+        }
+        decodeBody(t, rec, &inserted)
+        if rec.Code != http.StatusCreated || len(inserted.InsertedIDs) != 2 {
+            t.Fatalf("got %d %+v", rec.Code, inserted)
+        }
+
+        expectError(t, api.do(t, http.MethodPost, "/messages/bulk", "Bob", []gin.H{}), http.StatusBadRequest, codeValidation)
+        expectError(t, api.do(t, http.MethodPost, "/messages/bulk", "Bob", []gin.H{{"recipient": "Bob", "content": "self"}}), http.StatusBadRequest, codeValidation)
+        expectError(t, api.do(t, http.MethodPost, "/messages/bulk", "Bob", []gin.H{{"recipient": "Alice", "content": "Re", "replyTo": "64bd837566b7829eaa7ea650"}}), http.StatusBadRequest, codeValidation)
+        expectError(t, api.do(t, http.MethodPost, "/messages/bulk", "Bob", []gin.H{{"recipient": "Alice", "content": "Late", "deliverAt": time.Now().Add(-time.Hour)}}), http.StatusBadRequest, codeValidation)
+
+        // Bulk messages are stamped like single ones, a deliverAt schedules the message
+        ids := append(inserted.InsertedIDs, "64bd837566b7829eaa7ea650")
+        var messages []Message
+        rec = api.do(t, http.MethodPost, "/messages/batch-get", "Bob", BatchGetRequest{IDs: ids})
+        decodeBody(t, rec, &messages)
+        if rec.Code != http.StatusOK || len(messages) != 2 {
+            t.Fatalf("got %d with %d messages, want 2", rec.Code, len(messages))
+        }
+        for _, message := range messages {
+            if message.ForwardedFrom != nil || message.Read {
+                t.Fatalf("client-supplied fields were stored: %+v", message)
+            }
+            if scheduled := message.DeliverAt != nil; scheduled != (message.Status == statusScheduled) {
+                t.Fatalf("got status %q with deliverAt %v", message.Status, message.DeliverAt)
+            }
+        }
+    })
+
+    t.Run("conversations and inbox", func(t *testing.T) {
+        api.reset(t)
+        api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Hi Alice"})
+        api.send(t, "Alice", gin.H{"recipient": "Bob", "content": "Hi Bob"})
+        api.send(t, "Carol", gin.H{"recipient": "Alice", "content": "Hi from Carol"})
+
+        tests := []struct {
+            name  string
+            path  string
+            count int
+        }{
+            {"conversation", "/conversations?userA=Alice&userB=Bob", 2},
+            {"inbox", "/users/Alice/inbox", 2},
+            {"sent", "/users/Alice/sent", 1},
+        }
+        for _, tt := range tests {
+            t.Run(tt.name, func(t *testing.T) {
+                rec := api.do(t, http.MethodGet, tt.path, "Alice", nil)
+                var messages []Message
+                decodeBody(t, rec, &messages)
+                if rec.Code != http.StatusOK || len(messages) != tt.count {
+                    t.Fatalf("got %d with %d messages, want %d", rec.Code, len(messages), tt.count)
+                }
+            })
+        }
+
+        expectError(t, api.do(t, http.MethodGet, "/conversations?userA=Alice", "Alice", nil), http.StatusBadRequest, codeInvalidQuery)
+
+        // Only a participant can clear the conversation
+        expectError(t, api.do(t, http.MethodDelete, "/conversations?userA=Alice&userB=Bob", "Carol", nil), http.StatusForbidden, codeForbidden)
+        rec := api.do(t, http.MethodDelete, "/conversations?userA=Alice&userB=Bob", "Bob", nil)
+        var body struct {
+            Deleted int64 `json:"deleted"`
+        }
+        decodeBody(t, rec, &body)
+        if rec.Code != http.StatusOK || body.Deleted != 2 {
+            t.Fatalf("deleting conversation: got %d %+v", rec.Code, body)
+        }
+    })
+
+    t.Run("drafts stay private", func(t *testing.T) {
+        api.reset(t)
+        rec := api.do(t, http.MethodPost, "/drafts", "Bob", gin.H{"recipient": "Alice"})
+        var draft Message
+        decodeBody(t, rec, &draft)
+        if rec.Code != http.StatusCreated || !draft.Draft {
+            t.Fatalf("creating draft: got %d %+v", rec.Code, draft)
+        }
+        path := "/messages/" + draft.ID.Hex()
+
+        if rec := api.do(t, http.MethodGet, path, "Bob", nil); rec.Code != http.StatusOK {
+            t.Fatalf("author reading draft: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodGet, path, "Alice", nil), http.StatusNotFound, codeMessageNotFound)
+        if rec := api.do(t, http.MethodHead, path, "Alice", nil); rec.Code != http.StatusNotFound {
+            t.Fatalf("recipient checking draft: got %d", rec.Code)
+        }
+
+        // Nobody but the author can change the draft or learn it exists by replying to it
+        for _, tt := range []struct {
+            method string
+            path   string
+            body   gin.H
+        }{
+            {http.MethodPatch, path, gin.H{"content": "Taken over"}},
+            {http.MethodPatch, path + "/content", gin.H{"content": "Taken over"}},
+            {http.MethodPatch, path + "/recipient", gin.H{"recipient": "Carol"}},
+            {http.MethodPut, path, gin.H{"recipient": "Bob", "content": "Taken over"}},
+            {http.MethodPatch, path + "/status", gin.H{"status": statusDelivered}},
+            {http.MethodPost, path + "/read", nil},
+            {http.MethodPost, path + "/reactions", gin.H{"emoji": "👍"}},
+            {http.MethodDelete, path + "/reactions?emoji=%F0%9F%91%8D", nil},
+            {http.MethodDelete, path, nil},
+        } {
+            expectError(t, api.do(t, tt.method, tt.path, "Alice", tt.body), http.StatusNotFound, codeMessageNotFound)
+        }
+        expectError(t, api.do(t, http.MethodPost, "/messages", "Alice", gin.H{"recipient": "Bob", "content": "Re", "replyTo": draft.ID}), http.StatusBadRequest, codeValidation)
+        rec = api.do(t, http.MethodGet, path, "Bob", nil)
+        var unchanged Message
+        decodeBody(t, rec, &unchanged)
+        if unchanged.Content != "" || unchanged.Recipient != "Alice" || len(unchanged.Reactions) != 0 || unchanged.Version != draft.Version {
+            t.Fatalf("draft was changed by another user: %+v", unchanged)
+        }
+
+        // An incomplete draft can't be sent, nor can another user send it
+        expectError(t, api.do(t, http.MethodPost, "/drafts/"+draft.ID.Hex()+"/send", "Bob", nil), http.StatusBadRequest, codeValidation)
+        if rec := api.do(t, http.MethodPut, path, "Bob", gin.H{"recipient": "Alice", "content": "Finished"}); rec.Code != http.StatusOK {
+            t.Fatalf("finishing draft: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodPost, "/drafts/"+draft.ID.Hex()+"/send", "Alice", nil), http.StatusNotFound, codeMessageNotFound)
+
+        rec = api.do(t, http.MethodPost, "/drafts/"+draft.ID.Hex()+"/send", "Bob", nil)
+        var sent Message
+        decodeBody(t, rec, &sent)
+        if rec.Code != http.StatusOK || sent.Draft || sent.Status != statusSent {
+            t.Fatalf("sending draft: got %d %+v", rec.Code, sent)
+        }
+        if rec := api.do(t, http.MethodGet, path, "Alice", nil); rec.Code != http.StatusOK {
+            t.Fatalf("recipient reading sent draft: got %d", rec.Code)
+        }
+    })
+
+    t.Run("scheduled messages wait for delivery", func(t *testing.T) {
+        api.reset(t)
+        message := api.send(t, "Bob", gin.H{"recipient": "Alice", "content": "Later", "deliverAt": time.Now().Add(time.Hour)})
+        if message.Status != statusScheduled {
+            t.Fatalf("got status %q, want %q", message.Status, statusScheduled)
+        }
+        path := "/messages/" + message.ID.Hex()
+
+        if rec := api.do(t, http.MethodGet, path, "Bob", nil); rec.Code != http.StatusOK {
+            t.Fatalf("sender reading scheduled message: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodGet, path, "Alice", nil), http.StatusNotFound, codeMessageNotFound)
+
+        for _, listPath := range []string{"/messages?recipient=Alice", "/users/Alice/inbox", "/users/Bob/sent", "/conversations?userA=Alice&userB=Bob"} {
+            var messages []Message
+            decodeBody(t, api.do(t, http.MethodGet, listPath, "Alice", nil), &messages)
+            if len(messages) != 0 {
+                t.Fatalf("%s showed the scheduled message to the recipient", listPath)
+            }
+        }
+
+        // Neither reading nor replacing it lets the message out before its delivery time
+        expectError(t, api.do(t, http.MethodPost, path+"/read", "Alice", nil), http.StatusNotFound, codeMessageNotFound)
+        rec := api.do(t, http.MethodPut, path, "Bob", gin.H{"recipient": "Alice", "content": "Later, edited"})
+        var replaced struct {
+            UpdatedMessage Message `json:"updatedMessage"`
+        }
+        decodeBody(t, rec, &replaced)
+        if rec.Code != http.StatusOK || replaced.UpdatedMessage.Status != statusScheduled || replaced.UpdatedMessage.DeliverAt == nil {
+            t.Fatalf("replacing scheduled message: got %d %+v", rec.Code, replaced.UpdatedMessage)
+        }
+
+        if rec := api.do(t, http.MethodPost, path+"/cancel", "Bob", nil); rec.Code != http.StatusOK {
+            t.Fatalf("cancelling: got %d", rec.Code)
+        }
+        expectError(t, api.do(t, http.MethodGet, path, "Bob", nil), http.StatusNotFound, codeMessageNotFound)
+    })
+
+    t.Run("unknown route", func(t *testing.T) {
+        expectError(t, api.do(t, http.MethodGet, "/nope", "Alice", nil), http.StatusNotFound, codeRouteNotFound)
+    })
+}
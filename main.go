@@ -1,222 +1,3693 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	_ "tutorial/docs"
+)
+
+type Message struct {
+    ID             primitive.ObjectID  `bson:"_id,omitempty"`
+    Recipient      string              `bson:"recipient" binding:"required"`
+    Sender         string              `bson:"sender" binding:"required"`
+    Content        string              `bson:"content" binding:"required"`
+    Timestamp      time.Time           `bson:"timestamp"`
+    UpdatedAt      time.Time           `bson:"updatedAt,omitempty"`
+    Read           bool                `bson:"read"`
+    DeletedAt      *time.Time          `bson:"deletedAt,omitempty"`
+    ExpiresAt      *time.Time          `bson:"expiresAt,omitempty"`
+    History        []MessageVersion    `bson:"history,omitempty"`
+    ReplyTo        *primitive.ObjectID `bson:"replyTo,omitempty"`
+    Status         string              `bson:"status,omitempty"`
+    Version        int                 `bson:"version"`
+    Attachments    []Attachment        `bson:"attachments,omitempty"`
+    Labels         []string            `bson:"labels,omitempty"`
+    IdempotencyKey string              `bson:"idempotencyKey,omitempty" json:"-"`
+    Reactions      map[string][]string `bson:"reactions,omitempty"`
+    DeliverAt      *time.Time          `bson:"deliverAt,omitempty"`
+    Draft          bool                `bson:"draft,omitempty"`
+    ForwardedFrom  *primitive.ObjectID `bson:"forwardedFrom,omitempty"`
+}
+
+// Attachment references a file stored outside MongoDB, only its metadata is kept here
+type Attachment struct {
+    Name        string `bson:"name"`
+    URL         string `bson:"url"`
+    ContentType string `bson:"contentType"`
+    Size        int64  `bson:"size"`
+}
+
+const maxAttachments = 10
+
+// validateAttachments returns the attachment fields that are invalid
+func validateAttachments(attachments []Attachment) []string {
+    invalidFields := []string{}
+    if len(attachments) > maxAttachments {
+        return append(invalidFields, "attachments")
+    }
+
+    for i, attachment := range attachments {
+        if strings.TrimSpace(attachment.Name) == "" {
+            invalidFields = append(invalidFields, fmt.Sprintf("attachments[%d].name", i))
+        }
+        parsed, err := url.ParseRequestURI(attachment.URL)
+        if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+            invalidFields = append(invalidFields, fmt.Sprintf("attachments[%d].url", i))
+        }
+        if attachment.Size < 0 {
+            invalidFields = append(invalidFields, fmt.Sprintf("attachments[%d].size", i))
+        }
+    }
+    return invalidFields
+}
+
+// validateLabels returns the labels that are blank
+func validateLabels(labels []string) []string {
+    invalidFields := []string{}
+    for i, label := range labels {
+        if strings.TrimSpace(label) == "" {
+            invalidFields = append(invalidFields, fmt.Sprintf("labels[%d]", i))
+        }
+    }
+    return invalidFields
+}
+
+// Delivery statuses a message moves through
+const (
+    statusSent      = "sent"
+    statusDelivered = "delivered"
+    statusRead      = "read"
+    statusFailed    = "failed"
+    // Scheduled messages are held back until deliverAt, only the scheduler moves them on to sent
+    statusScheduled = "scheduled"
+)
+
+// statusTransitions lists, for each status, the statuses a message may move to from it
+var statusTransitions = map[string][]string{
+    statusSent:      {statusDelivered, statusRead, statusFailed},
+    statusDelivered: {statusRead},
+    statusFailed:    {statusSent},
+    statusRead:      {},
+}
+
+// statusesAllowingTransitionTo returns the statuses a message must be in to move to target, documents
+// written before statuses existed have none and count as sent
+func statusesAllowingTransitionTo(target string) bson.A {
+    sources := bson.A{target}
+    if target == statusSent {
+        sources = append(sources, nil)
+    }
+    for from, targets := range statusTransitions {
+        for _, to := range targets {
+            if to == target {
+                sources = append(sources, from)
+                if from == statusSent {
+                    sources = append(sources, nil)
+                }
+            }
+        }
+    }
+    return sources
+}
+
+// StatusUpdate is the request body for a delivery status transition
+type StatusUpdate struct {
+    Status string `json:"status"`
+}
+
+// BatchGetRequest is the request body for fetching several messages by ID
+type BatchGetRequest struct {
+    IDs []string `json:"ids"`
+}
+
+// MessageVersion is a snapshot of a message as it was before an edit
+type MessageVersion struct {
+    Recipient string    `bson:"recipient"`
+    Sender    string    `bson:"sender"`
+    Content   string    `bson:"content"`
+    EditedAt  time.Time `bson:"editedAt"`
+}
+
+// MessagePatch holds the fields a client may change with a partial update, the sender is fixed once a message exists
+type MessagePatch struct {
+    Recipient string   `json:"recipient"`
+    Content   string   `json:"content"`
+    Labels    []string `json:"labels"`
+    Version   *int     `json:"version"`
+}
+
+var logger *zap.Logger
+
+// dbTimeout bounds every database operation made by the handlers
+var dbTimeout = 5 * time.Second
+
+// maxContentLength caps message content, counted in runes so multibyte text isn't penalised
+var maxContentLength = 4096
+
+// contentTooLong reports whether the content exceeds maxContentLength
+func contentTooLong(content string) bool {
+    return utf8.RuneCountInString(content) > maxContentLength
+}
+
+// respondContentTooLong rejects content over the configured limit
+func respondContentTooLong(c *gin.Context) {
+    respondError(c, http.StatusBadRequest, codeValidation, fmt.Sprintf("content must not exceed %d characters", maxContentLength), gin.H{"fields": []string{"content"}, "limit": maxContentLength})
+    loggerFrom(c).Warn("Content exceeds maximum length")
+}
+
+// messageRetention is how long a message is kept before the TTL index reaps it, zero keeps it forever
+var messageRetention time.Duration
+
+// applyExpiry sets ExpiresAt from the retention period unless the client supplied its own
+func applyExpiry(message *Message, now time.Time) {
+    if message.ExpiresAt == nil && messageRetention > 0 {
+        expiresAt := now.Add(messageRetention)
+        message.ExpiresAt = &expiresAt
+    }
+}
+
+// editWindow is how long after sending a message can still be edited, zero allows edits at any time
+var editWindow time.Duration
+
+// checkEditWindow answers 403 itself once the message was sent more than editWindow ago, drafts and scheduled messages
+// haven't reached anyone so they stay editable, and a missing message is left for the update to report
+func checkEditWindow(ctx context.Context, c *gin.Context, repo MessageRepository, id primitive.ObjectID) bool {
+    if editWindow == 0 {
+        return true
+    }
+
+    message, err := repo.GetByID(ctx, id)
+    if err == mongo.ErrNoDocuments {
+        return true
+    }
+    if err != nil {
+        respondDBError(c, err, "Failed to find message")
+        return false
+    }
+    if message.Draft || message.Status == statusScheduled || time.Since(message.Timestamp) <= editWindow {
+        return true
+    }
+
+    respondError(c, http.StatusForbidden, codeEditWindowExpired, "edit window expired", gin.H{"editWindow": editWindow.String()})
+    loggerFrom(c).Warn(fmt.Sprintf("Edit window expired for message %s", id.Hex()))
+    return false
+}
+
+// checkVisible answers 404 itself when the message is a draft or scheduled message of someone other than the
+// authenticated user, so only its sender can change it, a missing message is left for the operation to report
+func checkVisible(ctx context.Context, c *gin.Context, repo MessageRepository, id primitive.ObjectID) bool {
+    user, err := authenticatedUser(c)
+    if err != nil {
+        respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+        loggerFrom(c).Warn("Not authenticated")
+        return false
+    }
+
+    message, err := repo.GetByID(ctx, id)
+    if err == mongo.ErrNoDocuments {
+        return true
+    }
+    if err != nil {
+        respondDBError(c, err, "Failed to find message")
+        return false
+    }
+    if visibleToUser(message, user) {
+        return true
+    }
+
+    respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+    loggerFrom(c).Warn(fmt.Sprintf("Message %s is not visible to %s", id.Hex(), user))
+    return false
+}
+
+// checkAddressees answers 400 itself when applying fields would address the message to its own sender,
+// a missing message is left for the update to report
+func checkAddressees(ctx context.Context, c *gin.Context, repo MessageRepository, id primitive.ObjectID, fields bson.M) bool {
+    recipient, recipientChanged := fields["recipient"].(string)
+    if allowSelfMessages || !recipientChanged {
+        return true
+    }
+
+    message, err := repo.GetByID(ctx, id)
+    if err == mongo.ErrNoDocuments {
+        return true
+    }
+    if err != nil {
+        respondDBError(c, err, "Failed to find message")
+        return false
+    }
+    if !selfAddressed(message.Sender, recipient) {
+        return true
+    }
+
+    respondError(c, http.StatusBadRequest, codeValidation, "recipient must differ from the sender", gin.H{"fields": []string{"recipient"}})
+    loggerFrom(c).Warn(fmt.Sprintf("Message %s would be addressed to its own sender %s", id.Hex(), message.Sender))
+    return false
+}
+
+// newDBContext creates a context for a single database operation, cancelled early if the client goes away
+func newDBContext(c *gin.Context) (context.Context, context.CancelFunc) {
+    return context.WithTimeout(c.Request.Context(), dbTimeout)
+}
+
+const (
+    defaultLimit = 50
+    maxLimit     = 500
+)
+
+// parsePagination reads the limit and offset query params, applying the defaults
+func parsePagination(c *gin.Context) (int64, int64, error) {
+    limit := int64(defaultLimit)
+    if value := c.Query("limit"); value != "" {
+        parsed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || parsed < 1 {
+            return 0, 0, fmt.Errorf("limit must be a positive integer")
+        }
+        if parsed > maxLimit {
+            return 0, 0, fmt.Errorf("limit must not exceed %d", maxLimit)
+        }
+        limit = parsed
+    }
+
+    var offset int64
+    if value := c.Query("offset"); value != "" {
+        parsed, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || parsed < 0 {
+            return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+        }
+        offset = parsed
+    }
+
+    return limit, offset, nil
+}
+
+// paginationLinks builds an RFC 5988 Link header value for the first, previous and next pages, keeping the other query params
+func paginationLinks(c *gin.Context, limit int64, offset int64, hasNext bool) string {
+    pageURL := func(pageOffset int64) string {
+        query := c.Request.URL.Query()
+        query.Set("limit", strconv.FormatInt(limit, 10))
+        query.Set("offset", strconv.FormatInt(pageOffset, 10))
+        return c.Request.URL.Path + "?" + query.Encode()
+    }
+
+    links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(0))}
+    if offset > 0 {
+        prevOffset := offset - limit
+        if prevOffset < 0 {
+            prevOffset = 0
+        }
+        links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(prevOffset)))
+    }
+    if hasNext {
+        links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(offset+limit)))
+    }
+    return strings.Join(links, ", ")
+}
+
+// sortableFields are the message fields the list endpoint may sort by
+var sortableFields = map[string]bool{
+    "timestamp": true,
+    "sender":    true,
+    "recipient": true,
+}
+
+// parseSort reads the sort and order query params, defaulting to timestamp descending
+func parseSort(c *gin.Context) (bson.D, error) {
+    field := c.DefaultQuery("sort", "timestamp")
+    if !sortableFields[field] {
+        return nil, fmt.Errorf("unknown sort field: %s", field)
+    }
+
+    var direction int
+    switch c.DefaultQuery("order", "desc") {
+    case "asc":
+        direction = 1
+    case "desc":
+        direction = -1
+    default:
+        return nil, fmt.Errorf("order must be asc or desc")
+    }
+
+    return bson.D{{Key: field, Value: direction}}, nil
+}
+
+// projectableFields maps the message fields the list endpoint may project to their JSON keys
+var projectableFields = map[string]string{
+    "recipient":     "Recipient",
+    "sender":        "Sender",
+    "content":       "Content",
+    "timestamp":     "Timestamp",
+    "updatedAt":     "UpdatedAt",
+    "read":          "Read",
+    "expiresAt":     "ExpiresAt",
+    "history":       "History",
+    "replyTo":       "ReplyTo",
+    "status":        "Status",
+    "version":       "Version",
+    "attachments":   "Attachments",
+    "labels":        "Labels",
+    "reactions":     "Reactions",
+    "deliverAt":     "DeliverAt",
+    "forwardedFrom": "ForwardedFrom",
+}
+
+// parseFields reads the comma-separated fields query param into a projection, returning nil when every field is wanted
+func parseFields(c *gin.Context) (bson.M, []string, error) {
+    fields := splitList(c.Query("fields"))
+    if len(fields) == 0 {
+        return nil, nil, nil
+    }
+
+    projection := bson.M{}
+    for _, field := range fields {
+        if _, ok := projectableFields[field]; !ok {
+            return nil, nil, fmt.Errorf("unknown field: %s", field)
+        }
+        projection[field] = 1
+    }
+    return projection, fields, nil
+}
+
+// selectMessageFields trims the encoded message down to its ID and the given fields, so unprojected fields aren't sent as zero values
+func selectMessageFields(message Message, fields []string) (map[string]json.RawMessage, error) {
+    encoded, err := json.Marshal(message)
+    if err != nil {
+        return nil, err
+    }
+    var all map[string]json.RawMessage
+    if err := json.Unmarshal(encoded, &all); err != nil {
+        return nil, err
+    }
+
+    trimmed := map[string]json.RawMessage{"ID": all["ID"]}
+    for _, field := range fields {
+        key := projectableFields[field]
+        trimmed[key] = all[key]
+    }
+    return trimmed, nil
+}
+
+// selectFields applies selectMessageFields to every message
+func selectFields(messages []Message, fields []string) ([]map[string]json.RawMessage, error) {
+    selected := make([]map[string]json.RawMessage, 0, len(messages))
+    for _, message := range messages {
+        trimmed, err := selectMessageFields(message, fields)
+        if err != nil {
+            return nil, err
+        }
+        selected = append(selected, trimmed)
+    }
+    return selected, nil
+}
+
+const readPreferenceHeader = "X-Read-Preference"
+
+// requestReadPreference reads the X-Read-Preference header or readPreference query param, answering 400 itself when
+// it is invalid, nil means the client's default
+func requestReadPreference(c *gin.Context) (*readpref.ReadPref, bool) {
+    value := c.GetHeader(readPreferenceHeader)
+    if value == "" {
+        value = c.Query("readPreference")
+    }
+    if value == "" {
+        return nil, true
+    }
+
+    mode, err := readpref.ModeFromString(value)
+    if err != nil {
+        respondError(c, http.StatusBadRequest, codeInvalidQuery, "readPreference must be primary, primaryPreferred, secondary, secondaryPreferred or nearest")
+        return nil, false
+    }
+    rp, err := readpref.New(mode)
+    if err != nil {
+        respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+        return nil, false
+    }
+    return rp, true
+}
+
+// withReadPreference returns a copy of the collection that reads with rp, or the collection itself when rp is nil
+func withReadPreference(collection *mongo.Collection, rp *readpref.ReadPref) *mongo.Collection {
+    if rp == nil {
+        return collection
+    }
+    // Clone only copies the options, it never fails
+    clone, _ := collection.Clone(options.Collection().SetReadPreference(rp))
+    return clone
+}
+
+// countMessages returns the total number of messages matching the filter
+func countMessages(ctx context.Context, collection *mongo.Collection, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+    return collection.CountDocuments(ctx, filter, opts...)
+}
+
+// notDeleted restricts the filter to messages that have not been soft-deleted
+func notDeleted(filter bson.M) bson.M {
+    filter["deletedAt"] = nil
+    return filter
+}
+
+// notDraft excludes drafts, which only show up through the drafts routes
+func notDraft(filter bson.M) bson.M {
+    filter["draft"] = bson.M{"$ne": true}
+    return filter
+}
+
+// delivered excludes drafts and scheduled messages that the recipient must not see yet
+func delivered(filter bson.M) bson.M {
+    filter["status"] = bson.M{"$ne": statusScheduled}
+    return notDraft(filter)
+}
+
+// visibleTo restricts the filter to messages user may see, drafts and undelivered scheduled messages only to their sender
+func visibleTo(filter bson.M, user string) bson.M {
+    clauses, _ := filter["$and"].(bson.A)
+    filter["$and"] = append(clauses, bson.M{"$or": bson.A{bson.M{"sender": user}, delivered(bson.M{})}})
+    return filter
+}
+
+// visibleToUser reports whether user may see the message, the single-message counterpart of visibleTo
+func visibleToUser(message Message, user string) bool {
+    return message.Sender == user || (!message.Draft && message.Status != statusScheduled)
+}
+
+// bindJSON binds the request body like ShouldBindJSON, and when strict also fails on fields obj doesn't declare
+func bindJSON(c *gin.Context, obj interface{}, strict bool) error {
+    if !strict {
+        return c.ShouldBindJSON(obj)
+    }
+
+    decoder := json.NewDecoder(c.Request.Body)
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(obj); err != nil {
+        return err
+    }
+    return binding.Validator.ValidateStruct(obj)
+}
+
+// parseObjectID reads a path param as an ObjectID, responding with a 400 when it isn't 24 hex characters
+func parseObjectID(c *gin.Context, param string) (primitive.ObjectID, bool) {
+    value := c.Param(param)
+    if len(value) != 24 {
+        respondError(c, http.StatusBadRequest, codeInvalidID, param+" must be a 24-character hex string")
+        loggerFrom(c).Warn("Invalid message ID: " + value)
+        return primitive.NilObjectID, false
+    }
+
+    objectID, err := primitive.ObjectIDFromHex(value)
+    if err != nil {
+        respondError(c, http.StatusBadRequest, codeInvalidID, param+" must be a 24-character hex string")
+        loggerFrom(c).Warn("Invalid message ID: " + value)
+        return primitive.NilObjectID, false
+    }
+    return objectID, true
+}
+
+// findMessages runs the query and decodes every matching document into a slice
+func findMessages(ctx context.Context, collection *mongo.Collection, filter interface{}, opts ...*options.FindOptions) ([]Message, error) {
+    cursor, err := collection.Find(ctx, filter, opts...)
+    if err != nil {
+        return nil, err
+    }
+    defer cursor.Close(ctx)
+
+    // Store the messages in a slice
+    var messages []Message = []Message{}
+    if err := cursor.All(ctx, &messages); err != nil {
+        return nil, err
+    }
+    return messages, nil
+}
+
+// findMessagePage returns one page of matching messages plus the total match count using a single $facet aggregation
+func findMessagePage(ctx context.Context, collection *mongo.Collection, filter bson.M, sort bson.D, limit int64, offset int64, projection bson.M) ([]Message, int64, error) {
+    page := bson.A{
+        bson.M{"$sort": sort},
+        bson.M{"$skip": offset},
+        bson.M{"$limit": limit},
+    }
+    if projection != nil {
+        page = append(page, bson.M{"$project": projection})
+    }
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: filter}},
+        {{Key: "$facet", Value: bson.M{
+            "data":  page,
+            "total": bson.A{bson.M{"$count": "count"}},
+        }}},
+    }
+
+    cursor, err := collection.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, 0, err
+    }
+    defer cursor.Close(ctx)
+
+    var results []struct {
+        Data  []Message `bson:"data"`
+        Total []struct {
+            Count int64 `bson:"count"`
+        } `bson:"total"`
+    }
+    if err := cursor.All(ctx, &results); err != nil {
+        return nil, 0, err
+    }
+
+    // $facet always yields one document, $count yields nothing when there are no matches
+    messages := []Message{}
+    var total int64
+    if len(results) > 0 {
+        if results[0].Data != nil {
+            messages = results[0].Data
+        }
+        if len(results[0].Total) > 0 {
+            total = results[0].Total[0].Count
+        }
+    }
+    return messages, total, nil
+}
+
+// buildMessageFilter builds a filter from the sender, recipient, label and from/to query params, leaving out
+// scheduled messages user didn't send
+func buildMessageFilter(c *gin.Context, user string) (bson.M, error) {
+    filter := bson.M{}
+    if sender := normalizeName(c.Query("sender")); sender != "" {
+        filter["sender"] = sender
+    }
+    if recipient := normalizeName(c.Query("recipient")); recipient != "" {
+        filter["recipient"] = recipient
+    }
+
+    // Case-insensitive name search for autocomplete, match=prefix anchors it to the start of the name
+    prefix := c.Query("match") == "prefix"
+    if match := c.Query("match"); match != "" && match != "prefix" && match != "substring" {
+        return nil, fmt.Errorf("match must be prefix or substring")
+    }
+    for _, field := range []string{"sender", "recipient"} {
+        search := strings.TrimSpace(c.Query(field + "Contains"))
+        if search == "" {
+            continue
+        }
+        if _, ok := filter[field]; ok {
+            return nil, fmt.Errorf("%s and %sContains can't be combined", field, field)
+        }
+        filter[field] = nameSearch(search, prefix)
+    }
+
+    // Repeated label params match messages carrying any of them
+    if labels := c.QueryArray("label"); len(labels) == 1 {
+        filter["labels"] = labels[0]
+    } else if len(labels) > 1 {
+        filter["labels"] = bson.M{"$in": labels}
+    }
+
+    // Either bound may be omitted for an open-ended range
+    timestampRange := bson.M{}
+    if from := c.Query("from"); from != "" {
+        parsed, err := time.Parse(time.RFC3339, from)
+        if err != nil {
+            return nil, fmt.Errorf("from must be an RFC3339 timestamp")
+        }
+        timestampRange["$gte"] = parsed
+    }
+    if to := c.Query("to"); to != "" {
+        parsed, err := time.Parse(time.RFC3339, to)
+        if err != nil {
+            return nil, fmt.Errorf("to must be an RFC3339 timestamp")
+        }
+        timestampRange["$lte"] = parsed
+    }
+    if len(timestampRange) > 0 {
+        filter["timestamp"] = timestampRange
+    }
+
+    return visibleTo(notDraft(notDeleted(filter)), user), nil
+}
+
+// nameSearch matches names containing search, or starting with it when prefix is set, metacharacters in search are matched literally
+func nameSearch(search string, prefix bool) primitive.Regex {
+    pattern := regexp.QuoteMeta(search)
+    if prefix {
+        pattern = "^" + pattern
+    }
+    return primitive.Regex{Pattern: pattern, Options: "i"}
+}
+
+// lowercaseNames case-folds sender and recipient names on top of trimming them
+var lowercaseNames = false
+
+// normalizeName trims a sender or recipient name, and lowercases it when lowercaseNames is set, so one user has one spelling
+func normalizeName(name string) string {
+    name = strings.TrimSpace(name)
+    if lowercaseNames {
+        name = strings.ToLower(name)
+    }
+    return name
+}
+
+// normalizeNames normalizes the message's sender and recipient in place
+func normalizeNames(message *Message) {
+    message.Sender = normalizeName(message.Sender)
+    message.Recipient = normalizeName(message.Recipient)
+}
+
+// allowSelfMessages lets users send messages to themselves, e.g. as notes
+var allowSelfMessages = false
+
+// selfAddressed reports whether a message from sender to recipient is one to themselves that isn't allowed
+func selfAddressed(sender string, recipient string) bool {
+    return !allowSelfMessages && recipient != "" && recipient == sender
+}
+
+// validateMessage returns the required fields that are missing or whitespace-only, plus any invalid optional fields
+func validateMessage(message Message) []string {
+    invalidFields := []string{}
+    if strings.TrimSpace(message.Recipient) == "" || selfAddressed(message.Sender, message.Recipient) {
+        invalidFields = append(invalidFields, "recipient")
+    }
+    if strings.TrimSpace(message.Sender) == "" {
+        invalidFields = append(invalidFields, "sender")
+    }
+    if strings.TrimSpace(message.Content) == "" || contentTooLong(message.Content) {
+        invalidFields = append(invalidFields, "content")
+    }
+    if message.ExpiresAt != nil && !message.ExpiresAt.After(time.Now()) {
+        invalidFields = append(invalidFields, "expiresAt")
+    }
+    invalidFields = append(invalidFields, validateAttachments(message.Attachments)...)
+    invalidFields = append(invalidFields, validateLabels(message.Labels)...)
+    return invalidFields
+}
+
+// buildUpdateFields returns a $set document containing only the non-empty patch fields
+func buildUpdateFields(patch MessagePatch) bson.M {
+    updatedFields := bson.M{}
+    if strings.TrimSpace(patch.Recipient) != "" {
+        updatedFields["recipient"] = normalizeName(patch.Recipient)
+    }
+    if strings.TrimSpace(patch.Content) != "" {
+        updatedFields["content"] = patch.Content
+    }
+    // An empty array clears the labels, omitting the field leaves them alone
+    if patch.Labels != nil {
+        updatedFields["labels"] = patch.Labels
+    }
+    return updatedFields
+}
+
+// appendHistory is an aggregation expression that appends the current version to the history array
+func appendHistory(editedAt time.Time) bson.M {
+    version := bson.M{
+        "recipient": "$recipient",
+        "sender":    "$sender",
+        "content":   "$content",
+        "editedAt":  editedAt,
+    }
+    return bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$history", bson.A{}}}, bson.A{version}}}
+}
+
+// incrementVersion is an aggregation expression for the next optimistic-locking version, missing counts as 0
+func incrementVersion() bson.M {
+    return bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}}
+}
+
+// updateWithHistory builds an update pipeline that archives the current version into history before applying the new fields
+func updateWithHistory(updatedFields bson.M, editedAt time.Time) mongo.Pipeline {
+
+    // Wrap values in $literal so content starting with "$" isn't read as a field path
+    set := bson.M{"history": appendHistory(editedAt), "version": incrementVersion()}
+    for field, value := range updatedFields {
+        set[field] = bson.M{"$literal": value}
+    }
+
+    return mongo.Pipeline{{{Key: "$set", Value: set}}}
+}
+
+// replaceWithHistory builds an update pipeline that archives the current version, then replaces the
+// document while keeping its original creation timestamp, history and the fields only the server sets
+func replaceWithHistory(replacement Message, editedAt time.Time) mongo.Pipeline {
+    return mongo.Pipeline{
+        {{Key: "$set", Value: bson.M{"history": appendHistory(editedAt), "version": incrementVersion()}}},
+        {{Key: "$replaceWith", Value: bson.M{"$mergeObjects": bson.A{
+            bson.M{"$literal": replacement},
+            bson.M{"timestamp": "$timestamp", "history": "$history", "version": "$version", "idempotencyKey": "$idempotencyKey", "reactions": "$reactions", "draft": "$draft", "forwardedFrom": "$forwardedFrom", "status": "$status", "deliverAt": "$deliverAt"},
+        }}}},
+    }
+}
+
+// streamFlushEvery is how many streamed list elements are written between flushes
+const streamFlushEvery = 100
+
+// streamMessages writes a page of messages as a JSON array one element at a time as they are read from the cursor
+func streamMessages(ctx context.Context, c *gin.Context, repo MessageRepository, filter bson.M, opts ListOptions, fields []string) {
+    // One message past the page is read to tell whether there is a next page, it is held back rather than written
+    lookahead := opts
+    lookahead.Limit = opts.Limit + 1
+
+    // Nothing is written until the first message arrives, so a failing query still gets a proper error response
+    streamed := 0
+    hasNext := false
+    err := repo.Each(ctx, filter, lookahead, func(message Message) error {
+        if int64(streamed) == opts.Limit {
+            hasNext = true
+            return nil
+        }
+
+        var element interface{} = message
+        if fields != nil {
+            trimmed, err := selectMessageFields(message, fields)
+            if err != nil {
+                return err
+            }
+            element = trimmed
+        }
+        encoded, err := json.Marshal(element)
+        if err != nil {
+            return err
+        }
+
+        separator := ","
+        if streamed == 0 {
+            // The Link header is only known once the cursor is drained, so it follows the body as a trailer
+            c.Header("Content-Type", "application/json; charset=utf-8")
+            c.Header("Trailer", "Link")
+            c.Status(http.StatusOK)
+            separator = "["
+        }
+        if _, err := c.Writer.WriteString(separator); err != nil {
+            return err
+        }
+        if _, err := c.Writer.Write(encoded); err != nil {
+            return err
+        }
+
+        streamed++
+        if streamed%streamFlushEvery == 0 {
+            c.Writer.Flush()
+        }
+        return nil
+    })
+
+    // The status is already sent once a message was written, so a failure after that can only cut the array short
+    if err != nil && streamed == 0 {
+        respondDBError(c, err, "Failed to retrieve messages")
+        return
+    }
+    if err != nil {
+        loggerFrom(c).Error(fmt.Sprintf("Message list stream ended after %d messages: %s", streamed, err.Error()))
+        return
+    }
+
+    if streamed == 0 {
+        c.Header("Link", paginationLinks(c, opts.Limit, opts.Offset, false))
+        c.JSON(http.StatusOK, []Message{})
+    } else {
+        c.Writer.WriteString("]")
+        c.Writer.Header().Set("Link", paginationLinks(c, opts.Limit, opts.Offset, hasNext))
+    }
+    loggerFrom(c).Info(fmt.Sprintf("Messages retrieved (%d)", streamed))
+}
+
+// getMessagesByCursor pages forward by _id, which is monotonic by creation time, so concurrent inserts don't shift pages
+func getMessagesByCursor(ctx context.Context, c *gin.Context, repo MessageRepository, filter bson.M, opts ListOptions, fields []string) {
+    if c.Query("offset") != "" {
+        respondError(c, http.StatusBadRequest, codeInvalidQuery, "offset cannot be combined with cursor pagination")
+        return
+    }
+
+    if after := c.Query("after"); after != "" {
+        afterID, err := primitive.ObjectIDFromHex(after)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, "after must be a message ID")
+            return
+        }
+        filter["_id"] = bson.M{"$gt": afterID}
+    }
+
+    opts.Sort = bson.D{{Key: "_id", Value: 1}}
+    messages, _, err := repo.List(ctx, filter, opts)
+    if err != nil {
+        respondDBError(c, err, "Failed to retrieve messages")
+        return
+    }
+    var data interface{} = messages
+    if fields != nil {
+        if data, err = selectFields(messages, fields); err != nil {
+            respondError(c, http.StatusInternalServerError, codeInternal, "Failed to encode messages")
+            loggerFrom(c).Error("Failed to encode messages: " + err.Error())
+            return
+        }
+    }
+
+    // A full page means there may be more to fetch
+    var nextCursor interface{}
+    if int64(len(messages)) == opts.Limit {
+        nextCursor = messages[len(messages)-1].ID.Hex()
+    }
+
+    c.JSON(http.StatusOK, gin.H{"data": data, "nextCursor": nextCursor})
+    loggerFrom(c).Info(fmt.Sprintf("Messages retrieved by cursor (%d)", len(messages)))
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages?paginate=cursor&after=64bd837566b7829eaa7ea650&limit=50"
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages?sender=Bob&recipient=Alice&label=urgent&label=work&from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z&sort=timestamp&order=desc&limit=50&offset=0&envelope=true"
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages?recipientContains=ali&match=prefix&limit=10"
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages?fields=sender,recipient,timestamp"
+// curl -i -H "Authorization: Bearer $TOKEN" -H "X-Read-Preference: secondaryPreferred" -X GET "http://localhost:8080/messages?sender=Bob"
+// @Summary      List messages
+// @Description  Returns a bare array unless envelope=true or paginate=cursor is given
+// @Tags         messages
+// @Produce      json
+// @Param        sender     query  string  false  "Filter by sender"
+// @Param        recipient  query  string  false  "Filter by recipient"
+// @Param        senderContains     query  string  false  "Case-insensitive search on the sender"
+// @Param        recipientContains  query  string  false  "Case-insensitive search on the recipient"
+// @Param        match              query  string  false  "How senderContains and recipientContains match (default substring)"  Enums(substring, prefix)
+// @Param        label      query  []string  false  "Filter by label, repeat to match any"  collectionFormat(multi)
+// @Param        from       query  string  false  "Earliest timestamp (RFC3339)"
+// @Param        to         query  string  false  "Latest timestamp (RFC3339)"
+// @Param        readPreference  query  string  false  "Replica set members to read from, also accepted as the X-Read-Preference header"  Enums(primary, primaryPreferred, secondary, secondaryPreferred, nearest)
+// @Param        sort      query  string  false  "Sort field"  Enums(timestamp, sender, recipient)
+// @Param        order     query  string  false  "Sort order"  Enums(asc, desc)
+// @Param        limit   query  int  false  "Page size (default 50, max 500)"
+// @Param        offset  query  int  false  "Number of messages to skip"
+// @Param        envelope  query  bool    false  "Wrap results with total, limit and offset"
+// @Param        paginate  query  string  false  "Pagination mode"  Enums(cursor)
+// @Param        fields    query  string  false  "Comma-separated fields to return besides the ID, e.g. sender,recipient,timestamp"
+// @Param        after     query  string  false  "Cursor: return messages after this ID"
+// @Success      200  {array}  Message
+// @Header       200  {string}  Link  "RFC 5988 links to the first, prev and next pages (offset pagination only, a trailer when the bare array is streamed)"
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages [get]
+func getMessages(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Read the pagination params
+        limit, offset, err := parsePagination(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Read the sort params
+        sort, err := parseSort(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Build the filter from the query params
+        filter, err := buildMessageFilter(c, user)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // List views can ask for just the fields they render
+        projection, fields, err := parseFields(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Reads that tolerate lag may go to a secondary
+        rp, ok := requestReadPreference(c)
+        if !ok {
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Cursor pagination is opt-in so existing clients keep the bare array
+        if c.Query("paginate") == "cursor" {
+            getMessagesByCursor(ctx, c, repo, filter, ListOptions{Limit: limit, Projection: projection, ReadPreference: rp}, fields)
+            return
+        }
+
+        // The bare array is streamed straight from the cursor so large pages aren't held in memory
+        envelope := c.Query("envelope") == "true"
+        if !envelope && c.NegotiateFormat(gin.MIMEJSON) == gin.MIMEJSON {
+            streamMessages(ctx, c, repo, filter, ListOptions{Sort: sort, Limit: limit, Offset: offset, Projection: projection, ReadPreference: rp}, fields)
+            return
+        }
+
+        // Fetch a page of messages, only counting the total for clients that opt in to the envelope
+        messages, total, err := repo.List(ctx, filter, ListOptions{Sort: sort, Limit: limit, Offset: offset, CountTotal: envelope, Projection: projection, ReadPreference: rp})
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve messages")
+            return
+        }
+        var data interface{} = messages
+        if fields != nil {
+            if data, err = selectFields(messages, fields); err != nil {
+                respondError(c, http.StatusInternalServerError, codeInternal, "Failed to encode messages")
+                loggerFrom(c).Error("Failed to encode messages: " + err.Error())
+                return
+            }
+        }
+
+        // Without a total, a full page means there may be another one
+        hasNext := int64(len(messages)) == limit
+        if envelope {
+            hasNext = offset+int64(len(messages)) < total
+        }
+        c.Header("Link", paginationLinks(c, limit, offset, hasNext))
+
+        // Wrap the page with paging info for clients that opt in
+        if envelope {
+            c.JSON(http.StatusOK, gin.H{"data": data, "total": total, "limit": limit, "offset": offset})
+            loggerFrom(c).Info(fmt.Sprintf("Messages retrieved (%d of %d)", len(messages), total))
+            return
+        }
+
+        c.JSON(http.StatusOK, data)
+        loggerFrom(c).Info(fmt.Sprintf("Messages retrieved (%d)", len(messages)))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages/count?sender=Bob&recipient=Alice"
+// @Summary      Count messages
+// @Tags         messages
+// @Produce      json
+// @Param        sender     query  string  false  "Filter by sender"
+// @Param        recipient  query  string  false  "Filter by recipient"
+// @Param        senderContains     query  string  false  "Case-insensitive search on the sender"
+// @Param        recipientContains  query  string  false  "Case-insensitive search on the recipient"
+// @Param        match              query  string  false  "How senderContains and recipientContains match (default substring)"  Enums(substring, prefix)
+// @Param        label      query  []string  false  "Filter by label, repeat to match any"  collectionFormat(multi)
+// @Param        from       query  string  false  "Earliest timestamp (RFC3339)"
+// @Param        to         query  string  false  "Latest timestamp (RFC3339)"
+// @Param        readPreference  query  string  false  "Replica set members to read from, also accepted as the X-Read-Preference header"  Enums(primary, primaryPreferred, secondary, secondaryPreferred, nearest)
+// @Success      200  {object}  map[string]int64
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/count [get]
+func getMessageCount(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Build the filter from the query params
+        filter, err := buildMessageFilter(c, user)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Reads that tolerate lag may go to a secondary
+        rp, ok := requestReadPreference(c)
+        if !ok {
+            return
+        }
+
+        // Count the matching messages without loading them
+        count, err := repo.Count(ctx, filter, ListOptions{ReadPreference: rp})
+        if err != nil {
+            respondDBError(c, err, "Failed to count messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"count": count})
+        loggerFrom(c).Info(fmt.Sprintf("Messages counted (%d)", count))
+    }
+}
+
+// exportFlushEvery is how many exported messages are written between flushes
+const exportFlushEvery = 100
+
+// curl -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages/export?sender=Bob&from=2024-01-01T00:00:00Z" > messages.ndjson
+// @Summary      Export messages as NDJSON
+// @Description  Streams every matching message, one JSON document per line, oldest first
+// @Tags         messages
+// @Produce      application/x-ndjson
+// @Param        sender     query  string  false  "Filter by sender"
+// @Param        recipient  query  string  false  "Filter by recipient"
+// @Param        senderContains     query  string  false  "Case-insensitive search on the sender"
+// @Param        recipientContains  query  string  false  "Case-insensitive search on the recipient"
+// @Param        match              query  string  false  "How senderContains and recipientContains match (default substring)"  Enums(substring, prefix)
+// @Param        label      query  []string  false  "Filter by label, repeat to match any"  collectionFormat(multi)
+// @Param        from       query  string  false  "Earliest timestamp (RFC3339)"
+// @Param        to         query  string  false  "Latest timestamp (RFC3339)"
+// @Param        readPreference  query  string  false  "Replica set members to read from, also accepted as the X-Read-Preference header"  Enums(primary, primaryPreferred, secondary, secondaryPreferred, nearest)
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/export [get]
+func exportMessages(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Build the filter from the query params
+        filter, err := buildMessageFilter(c, user)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Reads that tolerate lag may go to a secondary
+        rp, ok := requestReadPreference(c)
+        if !ok {
+            return
+        }
+
+        // The headers go out with the first message, so a failing query still gets a proper error response
+        writeHeaders := func() {
+            c.Header("Content-Type", "application/x-ndjson")
+            c.Header("Content-Disposition", `attachment; filename="messages.ndjson"`)
+            c.Status(http.StatusOK)
+        }
+
+        // An export outlives dbTimeout, so it is only bounded by the client staying connected, and each message
+        // is written as it is read so the export never sits in memory
+        ctx := c.Request.Context()
+        encoder := json.NewEncoder(c.Writer)
+        exported := 0
+        err = repo.Each(ctx, filter, ListOptions{Sort: bson.D{{Key: "_id", Value: 1}}, ReadPreference: rp}, func(message Message) error {
+            if exported == 0 {
+                writeHeaders()
+            }
+            if err := encoder.Encode(message); err != nil {
+                return err
+            }
+            exported++
+            if exported%exportFlushEvery == 0 {
+                c.Writer.Flush()
+            }
+            return nil
+        })
+        if err != nil && exported == 0 {
+            respondDBError(c, err, "Failed to export messages")
+            return
+        }
+
+        // The status is already sent, so a failure part way can only end the stream early
+        if err != nil {
+            loggerFrom(c).Error(fmt.Sprintf("Export failed after %d messages: %s", exported, err.Error()))
+            return
+        }
+        if exported == 0 {
+            writeHeaders()
+        }
+        c.Writer.Flush()
+        loggerFrom(c).Info(fmt.Sprintf("Messages exported (%d)", exported))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/messages/search?q=hello&limit=50&offset=0"
+// @Summary      Search message content
+// @Tags         messages
+// @Produce      json
+// @Param        q  query  string  true  "Search terms"
+// @Param        limit   query  int  false  "Page size (default 50, max 500)"
+// @Param        offset  query  int  false  "Number of messages to skip"
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/search [get]
+func searchMessages(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // A search term is required
+        query := strings.TrimSpace(c.Query("q"))
+        if query == "" {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, "q is required")
+            loggerFrom(c).Warn("Missing search query")
+            return
+        }
+
+        // Read the pagination params
+        limit, offset, err := parsePagination(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Best matches first, $text is case-insensitive by default
+        score := bson.M{"$meta": "textScore"}
+        opts := ListOptions{Sort: bson.D{{Key: "score", Value: score}}, Limit: limit, Offset: offset, Projection: bson.M{"score": score}}
+        filter := visibleTo(notDraft(notDeleted(bson.M{"$text": bson.M{"$search": query}})), user)
+        messages, _, err := repo.List(ctx, filter, opts)
+        if err != nil {
+            respondDBError(c, err, "Failed to search messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, messages)
+        loggerFrom(c).Info(fmt.Sprintf("Message search returned %d results", len(messages)))
+    }
+}
+
+// SenderStat is the number of messages sent by one sender
+type SenderStat struct {
+    Sender string `bson:"_id" json:"sender"`
+    Count  int64  `bson:"count" json:"count"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/stats/senders?limit=10"
+// @Summary      Per-sender message counts
+// @Tags         stats
+// @Produce      json
+// @Param        limit  query  int  false  "Only return the top N senders"
+// @Success      200  {array}  SenderStat
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /stats/senders [get]
+func getSenderStats(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Group the messages by sender, most active first
+        pipeline := mongo.Pipeline{
+            {{Key: "$match", Value: notDraft(notDeleted(bson.M{}))}},
+            {{Key: "$group", Value: bson.M{"_id": "$sender", "count": bson.M{"$sum": 1}}}},
+            {{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+        }
+
+        // Optionally keep only the top N senders
+        if value := c.Query("limit"); value != "" {
+            limit, err := strconv.ParseInt(value, 10, 64)
+            if err != nil || limit < 1 {
+                respondError(c, http.StatusBadRequest, codeInvalidQuery, "limit must be a positive integer")
+                return
+            }
+            pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        stats := []SenderStat{}
+        if err := repo.Aggregate(ctx, pipeline, &stats); err != nil {
+            respondDBError(c, err, "Failed to aggregate sender stats")
+            return
+        }
+
+        c.JSON(http.StatusOK, stats)
+        loggerFrom(c).Info(fmt.Sprintf("Sender stats retrieved (%d)", len(stats)))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/users/Alice/inbox?limit=50&offset=0"
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/users/Bob/sent?limit=50&offset=0"
+// @Summary      List a user's received or sent messages
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Param        limit   query  int  false  "Page size (default 50, max 500)"
+// @Param        offset  query  int  false  "Number of messages to skip"
+// @Param        readPreference  query  string  false  "Replica set members to read from, also accepted as the X-Read-Preference header"  Enums(primary, primaryPreferred, secondary, secondaryPreferred, nearest)
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/inbox [get]
+// @Router       /users/{user}/sent [get]
+func getUserMessages(repo MessageRepository, field string) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Read the pagination params
+        limit, offset, err := parsePagination(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Reads that tolerate lag may go to a secondary
+        rp, ok := requestReadPreference(c)
+        if !ok {
+            return
+        }
+
+        authUser, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Fetch a page of the user's messages newest first, scheduled ones only show up in the sender's own sent list
+        user := normalizeName(c.Param("user"))
+        filter := visibleTo(notDraft(notDeleted(bson.M{field: user})), authUser)
+        if field == "recipient" {
+            filter = delivered(filter)
+        }
+        opts := ListOptions{Sort: bson.D{{Key: "timestamp", Value: -1}}, Limit: limit, Offset: offset, ReadPreference: rp}
+        messages, _, err := repo.List(ctx, filter, opts)
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, messages)
+        loggerFrom(c).Info(fmt.Sprintf("Messages by %s %s retrieved (%d)", field, user, len(messages)))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET http://localhost:8080/users/Alice/unread-count
+// @Summary      Count a user's unread messages
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Success      200  {object}  map[string]int64
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/unread-count [get]
+func getUnreadCount(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Messages stored before the read field existed count as unread
+        user := normalizeName(c.Param("user"))
+        count, err := repo.Count(ctx, delivered(notDeleted(bson.M{"recipient": user, "read": bson.M{"$ne": true}})), ListOptions{})
+        if err != nil {
+            respondDBError(c, err, "Failed to count unread messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"count": count})
+        loggerFrom(c).Info(fmt.Sprintf("Unread messages for %s counted (%d)", user, count))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","content":"Hello, Al"}' http://localhost:8080/drafts
+// @Summary      Save a draft
+// @Description  The sender is always the authenticated user, recipient and content may still be empty
+// @Tags         drafts
+// @Accept       json
+// @Produce      json
+// @Param        message  body  Message  true  "Draft to save"
+// @Success      201  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /drafts [post]
+func createDraft(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Drafts are saved half-written, so the required fields aren't enforced yet
+        var message Message
+        if err := c.ShouldBindJSON(&message); err != nil {
+            var validationErrors validator.ValidationErrors
+            if !errors.As(err, &validationErrors) {
+                respondBindError(c, err)
+                return
+            }
+        }
+
+        // The sender is always the authenticated user
+        normalizeNames(&message)
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if message.Sender != "" && message.Sender != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Sender must match the authenticated user")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to save a draft as %s", user, message.Sender))
+            return
+        }
+        message.Sender = user
+
+        // What is there must still be valid
+        if contentTooLong(message.Content) {
+            respondContentTooLong(c)
+            return
+        }
+        invalidFields := append(validateAttachments(message.Attachments), validateLabels(message.Labels)...)
+        if len(invalidFields) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": invalidFields})
+            loggerFrom(c).Warn("Missing or invalid fields: " + strings.Join(invalidFields, ", "))
+            return
+        }
+
+        // The timestamp is stamped again when the draft is sent
+        message.Timestamp = time.Now().UTC()
+        message.UpdatedAt = time.Time{}
+        message.DeletedAt = nil
+        message.Draft = true
+        message.Read = false
+        message.Status = ""
+        message.Version = 0
+        message.Reactions = nil
+        message.History = nil
+        message.DeliverAt = nil
+        message.ExpiresAt = nil
+
+        message, _, err = repo.Create(ctx, message)
+        if err != nil {
+            respondDBError(c, err, "Failed to save draft")
+            return
+        }
+
+        c.Header("Location", "/messages/"+message.ID.Hex())
+        c.JSON(http.StatusCreated, message)
+        loggerFrom(c).Info(fmt.Sprintf("Draft %s saved", message.ID.Hex()))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST http://localhost:8080/drafts/64bd83ba66b7829eaa7ea651/send
+// @Summary      Send a draft
+// @Description  The draft must be complete, its timestamp becomes the time it was sent
+// @Tags         drafts
+// @Produce      json
+// @Param        id  path  string  true  "Draft ID (24-character hex)"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /drafts/{id}/send [post]
+func sendDraft(repo MessageRepository, hub *Hub, wsHub *wsHub) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the draft ID to MongoDB ObjectID
+        draftID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Another user's draft is reported as missing rather than forbidden
+        draft, err := repo.GetByID(ctx, objectID)
+        if err == nil && (!draft.Draft || draft.Sender != user) {
+            err = mongo.ErrNoDocuments
+        }
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Draft not found")
+                loggerFrom(c).Warn("Draft not found")
+            } else {
+                respondDBError(c, err, "Failed to find draft")
+            }
+            return
+        }
+
+        // Only a complete draft can be sent
+        if invalidFields := validateMessage(draft); len(invalidFields) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": invalidFields})
+            loggerFrom(c).Warn("Missing or invalid fields: " + strings.Join(invalidFields, ", "))
+            return
+        }
+        if !checkRecipientQuota(ctx, c, repo, user, draft.Recipient, 1) {
+            return
+        }
+
+        // Stamp the send time, the draft filter keeps a concurrent send from going out twice
+        sent := Message{Timestamp: time.Now().UTC()}
+        applyExpiry(&sent, sent.Timestamp)
+        set := bson.M{"timestamp": sent.Timestamp, "status": statusSent}
+        if sent.ExpiresAt != nil {
+            set["expiresAt"] = sent.ExpiresAt
+        }
+        update := bson.M{"$set": set, "$unset": bson.M{"draft": ""}}
+        message, err := repo.Modify(ctx, notDeleted(bson.M{"_id": objectID, "sender": user, "draft": true}), update)
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Draft not found")
+                loggerFrom(c).Warn("Draft not found")
+            } else {
+                respondDBError(c, err, "Failed to send draft")
+            }
+            return
+        }
+
+        hub.Publish(message)
+        wsHub.broadcast(message)
+
+        c.JSON(http.StatusOK, message)
+        loggerFrom(c).Info(fmt.Sprintf("Draft %s sent", draftID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/users/Bob/drafts?limit=50&offset=0"
+// @Summary      List a user's drafts
+// @Description  Users can only list their own drafts
+// @Tags         drafts
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Param        limit   query  int  false  "Page size (default 50, max 500)"
+// @Param        offset  query  int  false  "Number of drafts to skip"
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/drafts [get]
+func getUserDrafts(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Drafts are private to their author
+        user := normalizeName(c.Param("user"))
+        authUser, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if authUser != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Cannot list another user's drafts")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to list the drafts of %s", authUser, user))
+            return
+        }
+
+        // Read the pagination params
+        limit, offset, err := parsePagination(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Newest first
+        opts := ListOptions{Sort: bson.D{{Key: "timestamp", Value: -1}}, Limit: limit, Offset: offset}
+        messages, _, err := repo.List(ctx, notDeleted(bson.M{"sender": user, "draft": true}), opts)
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve drafts")
+            return
+        }
+
+        c.JSON(http.StatusOK, messages)
+        loggerFrom(c).Info(fmt.Sprintf("Drafts by %s retrieved (%d)", user, len(messages)))
+    }
+}
+
+// ConversationPreview is the latest message exchanged with one counterpart, plus how many of theirs are unread
+type ConversationPreview struct {
+    Counterpart string  `bson:"_id" json:"counterpart"`
+    LastMessage Message `bson:"lastMessage" json:"lastMessage"`
+    Unread      int64   `bson:"unread" json:"unread"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/users/Alice/conversations?limit=20&offset=0"
+// @Summary      List a user's conversations
+// @Description  One entry per counterpart with the latest message either way, most recent conversation first
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Param        limit   query  int  false  "Page size (default 50, max 500)"
+// @Param        offset  query  int  false  "Number of conversations to skip"
+// @Success      200  {array}  ConversationPreview
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/conversations [get]
+func getUserConversations(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Read the pagination params
+        limit, offset, err := parsePagination(c)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, err.Error())
+            return
+        }
+
+        // Group the user's messages by the other participant, keeping the newest of each group
+        user := normalizeName(c.Param("user"))
+        unread := bson.M{"$and": bson.A{bson.M{"$eq": bson.A{"$recipient", user}}, bson.M{"$ne": bson.A{"$read", true}}}}
+        pipeline := mongo.Pipeline{
+            {{Key: "$match", Value: delivered(notDeleted(bson.M{"$or": bson.A{bson.M{"sender": user}, bson.M{"recipient": user}}}))}},
+            {{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}}}},
+            {{Key: "$group", Value: bson.M{
+                "_id":         bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$sender", user}}, "$recipient", "$sender"}},
+                "lastMessage": bson.M{"$first": "$$ROOT"},
+                "unread":      bson.M{"$sum": bson.M{"$cond": bson.A{unread, 1, 0}}},
+            }}},
+            {{Key: "$sort", Value: bson.D{{Key: "lastMessage.timestamp", Value: -1}, {Key: "_id", Value: 1}}}},
+            {{Key: "$skip", Value: offset}},
+            {{Key: "$limit", Value: limit}},
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        conversations := []ConversationPreview{}
+        if err := repo.Aggregate(ctx, pipeline, &conversations); err != nil {
+            respondDBError(c, err, "Failed to aggregate conversations")
+            return
+        }
+
+        c.JSON(http.StatusOK, conversations)
+        loggerFrom(c).Info(fmt.Sprintf("Conversations of %s retrieved (%d)", user, len(conversations)))
+    }
+}
+
+// participantsFilter matches every message exchanged in either direction between two users
+func participantsFilter(userA string, userB string) bson.M {
+    return bson.M{"$or": []bson.M{
+        {"sender": userA, "recipient": userB},
+        {"sender": userB, "recipient": userA},
+    }}
+}
+
+// conversationFilter matches the messages between two users that have not been deleted, leaving out drafts
+func conversationFilter(userA string, userB string) bson.M {
+    return notDraft(notDeleted(participantsFilter(userA, userB)))
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET "http://localhost:8080/conversations?userA=Alice&userB=Bob"
+// @Summary      Get the conversation between two users
+// @Tags         conversations
+// @Produce      json
+// @Param        userA  query  string  true  "First participant"
+// @Param        userB  query  string  true  "Second participant"
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /conversations [get]
+func getConversation(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Both participants are required
+        userA := normalizeName(c.Query("userA"))
+        userB := normalizeName(c.Query("userB"))
+        if userA == "" || userB == "" {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, "userA and userB are required")
+            loggerFrom(c).Warn("Missing conversation participants")
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Fetch the thread oldest first, scheduled messages only show up for their sender until delivered
+        opts := ListOptions{Sort: bson.D{{Key: "timestamp", Value: 1}}}
+        messages, _, err := repo.List(ctx, visibleTo(conversationFilter(userA, userB), user), opts)
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve conversation")
+            return
+        }
+
+        c.JSON(http.StatusOK, messages)
+        loggerFrom(c).Info(fmt.Sprintf("Conversation between %s and %s retrieved", userA, userB))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X DELETE "http://localhost:8080/conversations?userA=Alice&userB=Bob&hard=false"
+// @Summary      Delete the conversation between two users
+// @Description  Only userA, userB or a token with the admin role may delete it
+// @Tags         conversations
+// @Produce      json
+// @Param        userA  query  string  true   "First participant"
+// @Param        userB  query  string  true   "Second participant"
+// @Param        hard   query  bool    false  "Permanently delete instead of soft-deleting"
+// @Success      200  {object}  map[string]int64
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /conversations [delete]
+func deleteConversation(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Both participants are required
+        userA := normalizeName(c.Query("userA"))
+        userB := normalizeName(c.Query("userB"))
+        if userA == "" || userB == "" {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, "userA and userB are required")
+            loggerFrom(c).Warn("Missing conversation participants")
+            return
+        }
+
+        // Only the participants, or an admin, may clear a conversation
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if user != userA && user != userB && !isAdmin(c) {
+            respondError(c, http.StatusForbidden, codeForbidden, "Cannot delete a conversation you are not part of")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to delete the conversation between %s and %s", user, userA, userB))
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Soft-delete by default like single messages, ?hard=true removes them for good
+        var deleted int64
+        if c.Query("hard") == "true" {
+            deleted, err = repo.DeleteMany(ctx, participantsFilter(userA, userB))
+        } else {
+            update := bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}}
+            deleted, err = repo.ModifyMany(ctx, conversationFilter(userA, userB), update)
+        }
+        if err != nil {
+            respondDBError(c, err, "Failed to delete conversation")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+        loggerFrom(c).Info(fmt.Sprintf("Conversation between %s and %s deleted (%d)", userA, userB, deleted))
+    }
+}
+
+// curl -I -H "Authorization: Bearer $TOKEN" http://localhost:8080/messages/64bd837566b7829eaa7ea650
+// @Summary      Check that a message exists
+// @Description  Answers with the status only, no body
+// @Tags         messages
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200
+// @Failure      400
+// @Failure      401
+// @Failure      404
+// @Failure      429
+// @Failure      500
+// @Failure      503
+// @Security     BearerAuth
+// @Router       /messages/{id} [head]
+func messageExists(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            c.Status(http.StatusUnauthorized)
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Stop at the first match, another user's draft or scheduled message counts as missing
+        count, err := repo.Count(ctx, visibleTo(notDeleted(bson.M{"_id": objectID}), user), ListOptions{Limit: 1})
+        if err != nil {
+            respondDBError(c, err, "Failed to check message")
+            return
+        }
+        if count == 0 {
+            c.Status(http.StatusNotFound)
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
+
+        c.Status(http.StatusOK)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s exists", messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET http://localhost:8080/messages/64bd837566b7829eaa7ea650
+// @Summary      Get a message
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id} [get]
+func getMessageByID(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Another user's draft or scheduled message is reported as missing rather than forbidden
+        message, err := repo.GetByID(ctx, objectID)
+        if err == nil && !visibleToUser(message, user) {
+            err = mongo.ErrNoDocuments
+        }
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+            } else {
+                respondDBError(c, err, "Failed to find message")
+            }
+            return
+        }
+        c.JSON(http.StatusOK, message)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s fetched", messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"ids":["64bd837566b7829eaa7ea650","64bd83ba66b7829eaa7ea651"]}' http://localhost:8080/messages/batch-get
+// @Summary      Get several messages by ID
+// @Description  Messages that don't exist are left out of the result
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        request  body  BatchGetRequest  true  "IDs to fetch (max 500)"
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/batch-get [post]
+func getMessagesByIDs(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Parse the ID list from the request body
+        var request BatchGetRequest
+        if err := c.ShouldBindJSON(&request); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        if request.IDs == nil {
+            respondError(c, http.StatusBadRequest, codeValidation, "ids is required", gin.H{"fields": []string{"ids"}})
+            return
+        }
+        if len(request.IDs) > maxLimit {
+            respondError(c, http.StatusBadRequest, codeValidation, fmt.Sprintf("ids must not contain more than %d entries", maxLimit))
+            return
+        }
+
+        // Every ID must be valid, otherwise nothing is fetched
+        objectIDs := make([]primitive.ObjectID, 0, len(request.IDs))
+        for i, id := range request.IDs {
+            objectID, err := primitive.ObjectIDFromHex(id)
+            if err != nil {
+                respondError(c, http.StatusBadRequest, codeInvalidID, "ids must be 24-character hex strings", gin.H{"index": i})
+                loggerFrom(c).Warn("Invalid message ID: " + id)
+                return
+            }
+            objectIDs = append(objectIDs, objectID)
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Other users' drafts and scheduled messages are left out like messages that don't exist
+        messages, _, err := repo.List(ctx, visibleTo(notDeleted(bson.M{"_id": bson.M{"$in": objectIDs}}), user), ListOptions{})
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, messages)
+        loggerFrom(c).Info(fmt.Sprintf("Messages retrieved by ID (%d of %d)", len(messages), len(objectIDs)))
+    }
+}
+
+const (
+    idempotencyKeyHeader    = "Idempotency-Key"
+    maxIdempotencyKeyLength = 255
+    duplicateHeader         = "X-Duplicate"
+)
+
+// recipientQuota is how many messages a sender may send one recipient per recipientQuotaWindow, zero disables the quota
+var (
+    recipientQuota       int64
+    recipientQuotaWindow time.Duration
+)
+
+// recipientQuotaRemaining returns how many more messages sender may send recipient now, and when the next slot frees
+// up once none are left
+func recipientQuotaRemaining(ctx context.Context, repo MessageRepository, sender string, recipient string) (int64, time.Duration, error) {
+    if recipientQuota == 0 {
+        return math.MaxInt64, 0, nil
+    }
+
+    filter := notDraft(bson.M{
+        "sender":    sender,
+        "recipient": recipient,
+        "timestamp": bson.M{"$gte": time.Now().UTC().Add(-recipientQuotaWindow)},
+    })
+    oldest, sent, err := repo.List(ctx, filter, ListOptions{Sort: bson.D{{Key: "timestamp", Value: 1}}, Limit: 1, CountTotal: true, Projection: bson.M{"timestamp": 1}})
+    if err != nil || sent < recipientQuota {
+        return recipientQuota - sent, 0, err
+    }
+
+    // The next slot frees up when the oldest message in the window ages out of it
+    return 0, time.Until(oldest[0].Timestamp.Add(recipientQuotaWindow)), nil
+}
+
+// checkRecipientQuota answers 429 itself when sending count more messages from sender to recipient would exceed the quota
+func checkRecipientQuota(ctx context.Context, c *gin.Context, repo MessageRepository, sender string, recipient string, count int64) bool {
+    remaining, retryAfter, err := recipientQuotaRemaining(ctx, repo, sender, recipient)
+    if err != nil {
+        respondDBError(c, err, "Failed to check the recipient quota")
+        return false
+    }
+    if count <= remaining {
+        return true
+    }
+
+    // Some room is left, just not enough for every message, so there is no exact time to give
+    if retryAfter <= 0 {
+        retryAfter = time.Second
+    }
+    c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+    respondError(c, http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("At most %d messages to %s per %s", recipientQuota, recipient, recipientQuotaWindow))
+    loggerFrom(c).Warn(fmt.Sprintf("User %s exceeded the quota for %s", sender, recipient))
+    return false
+}
+
+// prepareMessage validates a message its sender is sending now and resets the fields only the server sets, returning the
+// invalid fields, a replyTo to a missing message and a deliverAt that isn't in the future and before expiresAt among them
+func prepareMessage(ctx context.Context, repo MessageRepository, message *Message, now time.Time) ([]string, error) {
+    invalidFields := validateMessage(*message)
+
+    // A reply must reference an existing message the sender may see
+    if message.ReplyTo != nil {
+        parent, err := repo.GetByID(ctx, *message.ReplyTo)
+        if err == nil && !visibleToUser(parent, message.Sender) {
+            err = mongo.ErrNoDocuments
+        }
+        if err == mongo.ErrNoDocuments {
+            invalidFields = append(invalidFields, "replyTo")
+        } else if err != nil {
+            return nil, err
+        }
+    }
+    if message.DeliverAt != nil && (!message.DeliverAt.After(now) || (message.ExpiresAt != nil && !message.ExpiresAt.After(*message.DeliverAt))) {
+        invalidFields = append(invalidFields, "deliverAt")
+    }
+    if len(invalidFields) > 0 {
+        return invalidFields, nil
+    }
+
+    // Set the timestamp server-side, ignoring any client-supplied value, and new messages always start unread
+    message.ID = primitive.NilObjectID
+    message.Timestamp = now
+    message.UpdatedAt = time.Time{}
+    message.DeletedAt = nil
+    message.Read = false
+    message.Status = statusSent
+    message.Version = 0
+    message.Reactions = nil
+    message.History = nil
+    message.Draft = false
+    message.ForwardedFrom = nil
+
+    // A message to deliver later is held back as scheduled, and its retention starts once it is delivered
+    deliveredAt := now
+    if message.DeliverAt != nil {
+        deliverAt := message.DeliverAt.UTC()
+        message.DeliverAt = &deliverAt
+        message.Status = statusScheduled
+        deliveredAt = deliverAt
+    }
+    applyExpiry(message, deliveredAt)
+    return invalidFields, nil
+}
+
+// dedupWindow is how far back sendMessage looks for an identical message to return instead, zero disables the check
+var dedupWindow time.Duration
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","sender":"Bob","content":"Hello, Alice!","expiresAt":"2030-01-01T00:00:00Z"}' http://localhost:8080/messages
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","content":"Hello, Alice!"}' "http://localhost:8080/messages?dryRun=true"
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","content":"Hello, Alice!"}' "http://localhost:8080/messages?strict=true"
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","content":"Happy birthday!","deliverAt":"2030-06-01T09:00:00Z"}' http://localhost:8080/messages
+// curl -i -H "Authorization: Bearer $TOKEN" -H "Idempotency-Key: 3f2b6c1e-send-1" -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","content":"Hello, Alice!"}' http://localhost:8080/messages
+// @Summary      Send a message
+// @Description  The sender is always the authenticated user, a future deliverAt holds the message back as scheduled until then.
+// @Description  A message identical to one sent within DEDUP_WINDOW returns the earlier one with 200 and X-Duplicate: true.
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        message  body   Message  true   "Message to send"
+// @Param        dryRun   query  bool     false  "Validate without storing"
+// @Param        strict   query  bool     false  "Reject fields a message doesn't have"
+// @Param        Idempotency-Key  header  string  false  "Return the original message instead of sending a retry twice"
+// @Success      200  {object}  Message  "Dry run result, or the original message for a repeated Idempotency-Key or a duplicate"
+// @Header       200  {string}  X-Duplicate  "true when an identical message was sent within DEDUP_WINDOW"
+// @Success      201  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages [post]
+func sendMessage(repo MessageRepository, hub *Hub) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Create a message object from the request body, ?strict=true rejects fields the message doesn't have
+        var message Message
+        if err := bindJSON(c, &message, c.Query("strict") == "true"); err != nil {
+            var validationErrors validator.ValidationErrors
+            if !errors.As(err, &validationErrors) {
+                respondBindError(c, err)
+                return
+            }
+        }
+
+        // The sender is always the authenticated user
+        normalizeNames(&message)
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if message.Sender != "" && message.Sender != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Sender must match the authenticated user")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to send as %s", user, message.Sender))
+            return
+        }
+        message.Sender = user
+
+        // A retried request carries the same key, so it is remembered alongside the message
+        message.IdempotencyKey = c.GetHeader(idempotencyKeyHeader)
+        if len(message.IdempotencyKey) > maxIdempotencyKeyLength {
+            respondError(c, http.StatusBadRequest, codeValidation, fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+            loggerFrom(c).Warn("Idempotency key too long")
+            return
+        }
+
+        // Validate the content length and every other field, then stamp the fields only the server sets
+        if contentTooLong(message.Content) {
+            respondContentTooLong(c)
+            return
+        }
+        invalidFields, err := prepareMessage(ctx, repo, &message, time.Now().UTC())
+        if err != nil {
+            respondDBError(c, err, "Failed to find parent message")
+            return
+        }
+        if len(invalidFields) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": invalidFields})
+            loggerFrom(c).Warn("Missing or invalid fields: " + strings.Join(invalidFields, ", "))
+            return
+        }
+
+        // A dry run stops after validation and returns the message as it would be stored
+        if c.Query("dryRun") == "true" {
+            c.JSON(http.StatusOK, message)
+            loggerFrom(c).Info("Message validated (dry run)")
+            return
+        }
+
+        // A double-submitted message gets the first copy back instead of a second one
+        if dedupWindow > 0 && message.Status != statusScheduled {
+            filter := delivered(notDeleted(bson.M{
+                "sender":    message.Sender,
+                "recipient": message.Recipient,
+                "content":   message.Content,
+                "timestamp": bson.M{"$gte": message.Timestamp.Add(-dedupWindow)},
+            }))
+            recent, _, err := repo.List(ctx, filter, ListOptions{Sort: bson.D{{Key: "timestamp", Value: -1}}, Limit: 1})
+            if err != nil {
+                respondDBError(c, err, "Failed to check for duplicate messages")
+                return
+            }
+            if len(recent) > 0 {
+                c.Header(duplicateHeader, "true")
+                c.Header("Location", "/messages/"+recent[0].ID.Hex())
+                c.JSON(http.StatusOK, recent[0])
+                loggerFrom(c).Info(fmt.Sprintf("Message %s already sent within %s", recent[0].ID.Hex(), dedupWindow))
+                return
+            }
+        }
+
+        // Cap how many messages one sender can send one recipient within the quota window
+        if !checkRecipientQuota(ctx, c, repo, message.Sender, message.Recipient, 1) {
+            return
+        }
+
+        // Insert the message, a retry with a used idempotency key gets the original back instead
+        message, created, err := repo.Create(ctx, message)
+        if err != nil {
+            respondDBError(c, err, "Failed to insert message")
+            return
+        }
+        if !created {
+            c.Header("Location", "/messages/"+message.ID.Hex())
+            c.JSON(http.StatusOK, message)
+            loggerFrom(c).Info(fmt.Sprintf("Message %s already sent with idempotency key %s", message.ID.Hex(), message.IdempotencyKey))
+            return
+        }
+
+        // Return the complete inserted document, subscribers hear of a scheduled message once the scheduler delivers it
+        c.Header("Location", "/messages/"+message.ID.Hex())
+        c.JSON(http.StatusCreated, message)
+        if message.Status == statusScheduled {
+            loggerFrom(c).Info(fmt.Sprintf("Message %s scheduled for %s", message.ID.Hex(), message.DeliverAt.Format(time.RFC3339)))
+            return
+        }
+        hub.Publish(message)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s sent", message.ID.Hex()))
+    }
+}
+
+const maxBulkSize = 1000
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '[{"recipient":"Alice","sender":"Bob","content":"Hello, Alice!"},{"recipient":"Bob","sender":"Alice","content":"Hi, Bob!"}]' http://localhost:8080/messages/bulk
+// @Summary      Send messages in bulk
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        messages  body  []Message  true  "Messages to send (max 1000)"
+// @Success      201  {object}  map[string]interface{}
+// @Success      207  {object}  map[string]interface{}  "Some messages failed"
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/bulk [post]
+func sendMessagesBulk(repo MessageRepository, hub *Hub) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Create the message objects from the request body
+        var messages []Message
+        if err := json.NewDecoder(c.Request.Body).Decode(&messages); err != nil {
+            respondBindError(c, err)
+            return
+        }
+
+        if len(messages) == 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "No messages provided")
+            loggerFrom(c).Warn("No messages provided")
+            return
+        }
+        if len(messages) > maxBulkSize {
+            respondError(c, http.StatusBadRequest, codeValidation, fmt.Sprintf("Batch size must not exceed %d", maxBulkSize))
+            loggerFrom(c).Warn("Batch size exceeded")
+            return
+        }
+
+        // The sender of every message is always the authenticated user
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        for i := range messages {
+            normalizeNames(&messages[i])
+            if messages[i].Sender != "" && messages[i].Sender != user {
+                respondError(c, http.StatusForbidden, codeForbidden, "Sender must match the authenticated user", gin.H{"index": i})
+                loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to send as %s", user, messages[i].Sender))
+                return
+            }
+            messages[i].Sender = user
+        }
+
+        // Validate and stamp every message before inserting any of them
+        invalidMessages := []gin.H{}
+        now := time.Now().UTC()
+        for i := range messages {
+            invalidFields, err := prepareMessage(ctx, repo, &messages[i], now)
+            if err != nil {
+                respondDBError(c, err, "Failed to find parent message")
+                return
+            }
+            if len(invalidFields) > 0 {
+                invalidMessages = append(invalidMessages, gin.H{"index": i, "fields": invalidFields})
+            }
+        }
+        if len(invalidMessages) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"messages": invalidMessages})
+            loggerFrom(c).Warn(fmt.Sprintf("%d messages failed validation", len(invalidMessages)))
+            return
+        }
+
+        // Each recipient's quota must have room for all of their messages in the batch
+        perRecipient := map[string]int64{}
+        for _, message := range messages {
+            perRecipient[message.Recipient]++
+        }
+        for recipient, count := range perRecipient {
+            if !checkRecipientQuota(ctx, c, repo, user, recipient, count) {
+                return
+            }
+        }
+
+        // Assign IDs up front so failures can be reported by index
+        for i := range messages {
+            messages[i].ID = primitive.NewObjectID()
+        }
+
+        // Insert the messages, continuing past individual failures
+        err = repo.CreateMany(ctx, messages)
+        failedIndexes := []int{}
+        if err != nil {
+            var bulkErr mongo.BulkWriteException
+            if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+                respondDBError(c, err, "Failed to insert messages")
+                return
+            }
+            for _, writeErr := range bulkErr.WriteErrors {
+                failedIndexes = append(failedIndexes, writeErr.Index)
+            }
+        }
+
+        // Collect the IDs of the messages that were inserted, subscribers hear of scheduled ones once they are delivered
+        failed := map[int]bool{}
+        for _, index := range failedIndexes {
+            failed[index] = true
+        }
+        insertedIDs := []primitive.ObjectID{}
+        for i, message := range messages {
+            if !failed[i] {
+                insertedIDs = append(insertedIDs, message.ID)
+                if message.Status != statusScheduled {
+                    hub.Publish(message)
+                }
+            }
+        }
+
+        if len(failedIndexes) > 0 {
+            c.JSON(http.StatusMultiStatus, gin.H{"insertedIds": insertedIDs, "failedIndexes": failedIndexes})
+            loggerFrom(c).Warn(fmt.Sprintf("%d messages sent, %d failed", len(insertedIDs), len(failedIndexes)))
+            return
+        }
+
+        c.JSON(http.StatusCreated, gin.H{"insertedIds": insertedIDs})
+        loggerFrom(c).Info(fmt.Sprintf("%d messages sent", len(insertedIDs)))
+    }
+}
+
+const (
+    importBatchSize     = 500
+    maxReportedFailures = 100
+)
+
+// importFailure describes a line that could not be imported
+type importFailure struct {
+    Line   int    `json:"line"`
+    Reason string `json:"reason"`
+}
+
+// importSummary is the response of an NDJSON import
+type importSummary struct {
+    Inserted int             `json:"inserted"`
+    Failed   int             `json:"failed"`
+    Failures []importFailure `json:"failures"`
+}
+
+// fail records a failed line, only the first maxReportedFailures are listed
+func (s *importSummary) fail(line int, reason string) {
+    s.Failed++
+    if len(s.Failures) < maxReportedFailures {
+        s.Failures = append(s.Failures, importFailure{Line: line, Reason: reason})
+    }
+}
+
+// insertImportBatch inserts the batch unordered, counting each rejected document against its line
+func insertImportBatch(ctx context.Context, repo MessageRepository, batch []Message, lines []int, summary *importSummary) error {
+    err := repo.CreateMany(ctx, batch)
+    if err == nil {
+        summary.Inserted += len(batch)
+        return nil
+    }
+
+    var bulkErr mongo.BulkWriteException
+    if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+        return err
+    }
+    for _, writeErr := range bulkErr.WriteErrors {
+        summary.fail(lines[writeErr.Index], writeErr.Message)
+    }
+    summary.Inserted += len(batch) - len(bulkErr.WriteErrors)
+    return nil
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/x-ndjson" --data-binary @messages.ndjson http://localhost:8080/messages/import
+// @Summary      Import messages from NDJSON
+// @Description  Reads one message per line, skipping lines that fail validation. Timestamps and IDs in the file are kept
+// @Tags         messages
+// @Accept       application/x-ndjson
+// @Produce      json
+// @Success      200  {object}  importSummary
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/import [post]
+func importMessages(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Imported messages must all be from the authenticated user
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // An import outlives dbTimeout, so it is only bounded by the client staying connected
+        ctx := c.Request.Context()
+
+        // Read the body a line at a time, inserting every importBatchSize valid messages
+        summary := importSummary{Failures: []importFailure{}}
+        reader := bufio.NewReader(c.Request.Body)
+        batch := []Message{}
+        batchLines := []int{}
+        now := time.Now().UTC()
+
+        // Messages recent enough to fall in the quota window count against it, each recipient's room is looked up once
+        quotaLeft := map[string]int64{}
+        withinQuota := func(message Message) (bool, error) {
+            if recipientQuota == 0 || message.Timestamp.Before(now.Add(-recipientQuotaWindow)) {
+                return true, nil
+            }
+            left, ok := quotaLeft[message.Recipient]
+            if !ok {
+                var err error
+                if left, _, err = recipientQuotaRemaining(ctx, repo, user, message.Recipient); err != nil {
+                    return false, err
+                }
+            }
+            if left <= 0 {
+                quotaLeft[message.Recipient] = 0
+                return false, nil
+            }
+            quotaLeft[message.Recipient] = left - 1
+            return true, nil
+        }
+        for lineNumber := 1; ; lineNumber++ {
+            line, readErr := reader.ReadBytes('\n')
+            if readErr != nil && readErr != io.EOF {
+                var maxBytesErr *http.MaxBytesError
+                if errors.As(readErr, &maxBytesErr) {
+                    respondPayloadTooLarge(c, maxBytesErr.Limit)
+                    return
+                }
+                respondError(c, http.StatusBadRequest, codeInvalidBody, "Failed to read request body")
+                loggerFrom(c).Warn("Failed to read import body: " + readErr.Error())
+                return
+            }
+
+            if len(bytes.TrimSpace(line)) > 0 {
+                var message Message
+                if err := json.Unmarshal(line, &message); err != nil {
+                    summary.fail(lineNumber, "malformed JSON")
+                } else {
+                    normalizeNames(&message)
+                    if message.Sender == "" {
+                        message.Sender = user
+                    }
+                    invalidFields := validateMessage(message)
+
+                    // Only statuses a message can be in once sent are accepted, a scheduled one would be delivered again
+                    if _, ok := statusTransitions[message.Status]; message.Status != "" && !ok {
+                        invalidFields = append(invalidFields, "status")
+                    }
+
+                    // Keep the original timestamp so migrated conversations stay in order
+                    if message.Timestamp.IsZero() {
+                        message.Timestamp = now
+                    }
+                    if message.Sender != user {
+                        summary.fail(lineNumber, "sender must match the authenticated user")
+                    } else if len(invalidFields) > 0 {
+                        summary.fail(lineNumber, "missing or invalid fields: "+strings.Join(invalidFields, ", "))
+                    } else if ok, err := withinQuota(message); err != nil {
+                        loggerFrom(c).Warn(fmt.Sprintf("Import stopped after %d messages", summary.Inserted))
+                        respondDBError(c, err, "Failed to check the recipient quota")
+                        return
+                    } else if !ok {
+                        summary.fail(lineNumber, "recipient quota exceeded")
+                    } else {
+                        if message.Status == "" {
+                            message.Status = statusSent
+                        }
+                        applyExpiry(&message, message.Timestamp)
+                        batch = append(batch, message)
+                        batchLines = append(batchLines, lineNumber)
+                    }
+                }
+            }
+
+            if len(batch) == importBatchSize || (readErr == io.EOF && len(batch) > 0) {
+                if err := insertImportBatch(ctx, repo, batch, batchLines, &summary); err != nil {
+                    loggerFrom(c).Warn(fmt.Sprintf("Import stopped after %d messages", summary.Inserted))
+                    respondDBError(c, err, "Failed to import messages")
+                    return
+                }
+                batch = batch[:0]
+                batchLines = batchLines[:0]
+            }
+            if readErr == io.EOF {
+                break
+            }
+        }
+
+        c.JSON(http.StatusOK, summary)
+        loggerFrom(c).Info(fmt.Sprintf("Messages imported (%d inserted, %d failed)", summary.Inserted, summary.Failed))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X PATCH -H "Content-Type: application/json" -d '{"content":"Hello, Bob!","version":1}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651
+// @Summary      Partially update a message
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        patch  body  MessagePatch  true  "Fields to change"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Edit window expired"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      409  {object} ErrorResponse  "Conflict"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id} [patch]
+func updateMessage(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Parse the partial message data from the request body
+        var patch MessagePatch
+        if err := c.ShouldBindJSON(&patch); err != nil {
+            respondBindError(c, err)
+            return
+        }
+
+        if contentTooLong(patch.Content) {
+            respondContentTooLong(c)
+            return
+        }
+
+        if invalidFields := validateLabels(patch.Labels); len(invalidFields) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": invalidFields})
+            loggerFrom(c).Warn("Missing or invalid fields: " + strings.Join(invalidFields, ", "))
+            return
+        }
+
+        // Only set the fields that were provided
+        updatedFields := buildUpdateFields(patch)
+        if len(updatedFields) == 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "No fields to update")
+            loggerFrom(c).Warn("No fields to update")
+            return
+        }
+
+        // Messages can only be edited for a while after they are sent
+        if !checkVisible(ctx, c, repo, objectID) || !checkEditWindow(ctx, c, repo, objectID) {
+            return
+        }
+        if !checkAddressees(ctx, c, repo, objectID, updatedFields) {
+            return
+        }
+
+        // Perform the partial update of the existing message, keeping the prior version
+        message, err := repo.Update(ctx, objectID, updatedFields, patch.Version)
+        if err == mongo.ErrNoDocuments {
+            respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
+        if err == errVersionConflict {
+            respondError(c, http.StatusConflict, codeVersionConflict, "Message was modified by another request")
+            loggerFrom(c).Warn(fmt.Sprintf("Version conflict updating message %s", messageID))
+            return
+        }
+        if err != nil {
+            respondDBError(c, err, "Failed to update message")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"message": "Message updated successfully", "updatedMessage": message})
+        loggerFrom(c).Info(fmt.Sprintf("Message %s updated", messageID))
+    }
+}
+
+// ContentUpdate is the request body for a content-only edit
+type ContentUpdate struct {
+    Content string `json:"content"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X PATCH -H "Content-Type: application/json" -d '{"content":"edited"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/content
+// @Summary      Edit a message's content
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        content  body  ContentUpdate  true  "New content"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Edit window expired"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/content [patch]
+func updateMessageContent(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Only the content can be changed through this route
+        var contentUpdate ContentUpdate
+        if err := c.ShouldBindJSON(&contentUpdate); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        if strings.TrimSpace(contentUpdate.Content) == "" {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": []string{"content"}})
+            loggerFrom(c).Warn("Missing or invalid fields: content")
+            return
+        }
+        if contentTooLong(contentUpdate.Content) {
+            respondContentTooLong(c)
+            return
+        }
+
+        // Messages can only be edited for a while after they are sent
+        if !checkVisible(ctx, c, repo, objectID) || !checkEditWindow(ctx, c, repo, objectID) {
+            return
+        }
+
+        // Update the content and edit time, keeping the prior version
+        message, err := repo.Update(ctx, objectID, bson.M{"content": contentUpdate.Content}, nil)
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+            } else {
+                respondDBError(c, err, "Failed to update message")
+            }
+            return
+        }
+
+        c.JSON(http.StatusOK, message)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s content updated", messageID))
+    }
+}
+
+// RecipientUpdate is the request body for reassigning a message to another recipient
+type RecipientUpdate struct {
+    Recipient string `json:"recipient"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X PATCH -H "Content-Type: application/json" -d '{"recipient":"Carol"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/recipient
+// @Summary      Reassign a message to another recipient
+// @Description  The previous recipient is kept in the message history
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        recipient  body  RecipientUpdate  true  "New recipient"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Edit window expired"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/recipient [patch]
+func updateMessageRecipient(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Only the recipient can be changed through this route
+        var recipientUpdate RecipientUpdate
+        if err := c.ShouldBindJSON(&recipientUpdate); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        recipient := normalizeName(recipientUpdate.Recipient)
+        if recipient == "" {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": []string{"recipient"}})
+            loggerFrom(c).Warn("Missing or invalid fields: recipient")
+            return
+        }
+
+        // Messages can only be reassigned for as long as they can be edited, then the recipient and edit time
+        // are updated, keeping the prior version
+        fields := bson.M{"recipient": recipient}
+        if !checkVisible(ctx, c, repo, objectID) || !checkEditWindow(ctx, c, repo, objectID) {
+            return
+        }
+        if !checkAddressees(ctx, c, repo, objectID, fields) {
+            return
+        }
+        message, err := repo.Update(ctx, objectID, fields, nil)
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+            } else {
+                respondDBError(c, err, "Failed to update message")
+            }
+            return
+        }
+
+        c.JSON(http.StatusOK, message)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s reassigned to %s", messageID, recipient))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/cancel
+// @Summary      Cancel a scheduled message
+// @Description  Only the sender can cancel, and only before the message is delivered
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      409  {object} ErrorResponse  "Conflict"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/cancel [post]
+func cancelScheduledMessage(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // A cancelled message is soft-deleted, the status filter keeps the scheduler from delivering it first
+        filter := notDeleted(bson.M{"_id": objectID, "sender": user, "status": statusScheduled})
+        message, err := repo.Modify(ctx, filter, bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}})
+        if err == nil {
+            c.JSON(http.StatusOK, message)
+            loggerFrom(c).Info(fmt.Sprintf("Scheduled message %s cancelled", messageID))
+            return
+        }
+        if err != mongo.ErrNoDocuments {
+            respondDBError(c, err, "Failed to cancel message")
+            return
+        }
+
+        // Tell a message that was already delivered apart from one the user can't see
+        count, err := repo.Count(ctx, notDeleted(bson.M{"_id": objectID, "sender": user}), ListOptions{})
+        if err != nil {
+            respondDBError(c, err, "Failed to cancel message")
+            return
+        }
+        if count == 0 {
+            respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
+        respondError(c, http.StatusConflict, codeInvalidTransition, "Only scheduled messages can be cancelled")
+        loggerFrom(c).Warn(fmt.Sprintf("Message %s is no longer scheduled", messageID))
+    }
+}
+
+// ForwardRequest is the request body for forwarding a message to another recipient
+type ForwardRequest struct {
+    Recipient string `json:"recipient"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"recipient":"Carol"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/forward
+// @Summary      Forward a message
+// @Description  Sends a copy of the content and attachments from the authenticated user, who must have sent or received the original
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        forward  body  ForwardRequest  true  "Who to forward the message to"
+// @Success      201  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/forward [post]
+func forwardMessage(repo MessageRepository, hub *Hub) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        var forward ForwardRequest
+        if err := c.ShouldBindJSON(&forward); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        recipient := normalizeName(forward.Recipient)
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if recipient == "" || selfAddressed(user, recipient) {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": []string{"recipient"}})
+            loggerFrom(c).Warn("Missing or invalid fields: recipient")
+            return
+        }
+
+        // Drafts and scheduled messages haven't been sent, so there is nothing to forward yet
+        original, err := repo.GetByID(ctx, objectID)
+        if err == nil && (original.Draft || original.Status == statusScheduled) {
+            err = mongo.ErrNoDocuments
+        }
+        if err == mongo.ErrNoDocuments {
+            respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
+        if err != nil {
+            respondDBError(c, err, "Failed to find message")
+            return
+        }
+        if original.Sender != user && original.Recipient != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Only the sender or recipient can forward a message")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to forward message %s", user, messageID))
+            return
+        }
+        if !checkRecipientQuota(ctx, c, repo, user, recipient, 1) {
+            return
+        }
+
+        // The copy is a new message from the forwarding user that remembers where it came from
+        message := Message{
+            Recipient:     recipient,
+            Sender:        user,
+            Content:       original.Content,
+            Timestamp:     time.Now().UTC(),
+            Status:        statusSent,
+            Attachments:   original.Attachments,
+            ForwardedFrom: &original.ID,
+        }
+        applyExpiry(&message, message.Timestamp)
+
+        message, _, err = repo.Create(ctx, message)
+        if err != nil {
+            respondDBError(c, err, "Failed to forward message")
+            return
+        }
+        hub.Publish(message)
+
+        c.Header("Location", "/messages/"+message.ID.Hex())
+        c.JSON(http.StatusCreated, message)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s forwarded to %s as %s", messageID, recipient, message.ID.Hex()))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X PUT -H "Content-Type: application/json" -d '{"recipient":"Alice","sender":"Bob","content":"Hello, Bob!"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651
+// @Summary      Replace a message
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        message  body  Message  true  "Replacement message"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden, or edit window expired"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id} [put]
+func replaceMessage(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Parse the replacement message from the request body
+        var updatedMessage Message
+        if err := c.ShouldBindJSON(&updatedMessage); err != nil {
+            var validationErrors validator.ValidationErrors
+            if !errors.As(err, &validationErrors) {
+                respondBindError(c, err)
+                return
+            }
+        }
+
+        // The sender is always the authenticated user
+        normalizeNames(&updatedMessage)
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if updatedMessage.Sender != "" && updatedMessage.Sender != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Sender must match the authenticated user")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to send as %s", user, updatedMessage.Sender))
+            return
+        }
+        updatedMessage.Sender = user
+
+        // A full replacement needs every required field
+        if contentTooLong(updatedMessage.Content) {
+            respondContentTooLong(c)
+            return
+        }
+        if invalidFields := validateMessage(updatedMessage); len(invalidFields) > 0 {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": invalidFields})
+            loggerFrom(c).Warn("Missing or invalid fields: " + strings.Join(invalidFields, ", "))
+            return
+        }
+
+        // Messages can only be edited for a while after they are sent
+        if !checkVisible(ctx, c, repo, objectID) || !checkEditWindow(ctx, c, repo, objectID) {
+            return
+        }
+
+        // Perform the update by replacing the existing message, the creation timestamp is kept from the original
+        message, err := repo.Replace(ctx, objectID, updatedMessage)
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+            } else {
+                respondDBError(c, err, "Failed to update message")
+            }
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"message": "Message replaced successfully", "updatedMessage": message})
+        loggerFrom(c).Info(fmt.Sprintf("Message %s replaced", messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $ADMIN_TOKEN" -X POST http://localhost:8080/admin/purge
+// @Summary      Purge soft-deleted messages
+// @Description  Permanently removes messages soft-deleted longer than SOFT_DELETE_RETENTION ago, requires a token with the admin role
+// @Tags         admin
+// @Produce      json
+// @Success      200  {object}  map[string]int64
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /admin/purge [post]
+func purgeDeletedMessages(repo MessageRepository, retention time.Duration) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // Soft-deleted messages stay restorable for the retention window before they are removed for good
+        cutoff := time.Now().UTC().Add(-retention)
+        purged, err := repo.DeleteMany(ctx, bson.M{"deletedAt": bson.M{"$lt": cutoff}})
+        if err != nil {
+            respondDBError(c, err, "Failed to purge messages")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"purged": purged})
+        loggerFrom(c).Info(fmt.Sprintf("Messages soft-deleted before %s purged (%d)", cutoff.Format(time.RFC3339), purged))
+    }
+}
 
-	"time"
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/history
+// @Summary      Get a message's edit history
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200  {array}  MessageVersion
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/history [get]
+func getMessageHistory(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
 
-	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
-)
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
 
-type Message struct {
-    ID        primitive.ObjectID `bson:"_id,omitempty"`
-    Recipient string             `bson:"recipient"`
-    Sender    string             `bson:"sender"`
-    Content   string             `bson:"content"`
-    Timestamp time.Time          `bson:"timestamp"`
-}
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
 
-var logger *zap.Logger
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
 
-// curl -i -X GET http://localhost:8080/messages
-func getMessages(collection *mongo.Collection) func(c *gin.Context) {
-    return func(c *gin.Context) {
+        // Another user's draft or scheduled message has no history to show
+        message, err := repo.GetByID(ctx, objectID)
+        if err == nil && !visibleToUser(message, user) {
+            err = mongo.ErrNoDocuments
+        }
+        if err != nil {
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+            } else {
+                respondDBError(c, err, "Failed to find message")
+            }
+            return
+        }
+
+        // History is stored oldest first, return it newest first
+        versions := make([]MessageVersion, len(message.History))
+        for i, version := range message.History {
+            versions[len(message.History)-1-i] = version
+        }
 
-        logger.Info(c.Request.URL.Path)
+        c.JSON(http.StatusOK, versions)
+        loggerFrom(c).Info(fmt.Sprintf("Message %s history fetched", messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/replies
+// @Summary      List replies to a message
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200  {array}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/replies [get]
+func getMessageReplies(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
 
         // Create a context for the database operation
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        ctx, cancel := newDBContext(c)
         defer cancel()
 
-        // Fetch all messages from the collection
-        cursor, err := collection.Find(ctx, bson.D{})
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
             return
         }
-        defer cursor.Close(ctx)
 
-        // Store the messages in a slice
-        var messages []Message = []Message{}
-        if err := cursor.All(ctx, &messages); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode messages"})
+        // Fetch the replies oldest first, leaving out other users' drafts and scheduled messages
+        opts := ListOptions{Sort: bson.D{{Key: "timestamp", Value: 1}}}
+        messages, _, err := repo.List(ctx, visibleTo(notDeleted(bson.M{"replyTo": objectID}), user), opts)
+        if err != nil {
+            respondDBError(c, err, "Failed to retrieve replies")
             return
         }
 
         c.JSON(http.StatusOK, messages)
-        logger.Info("Messages retrieved")
+        loggerFrom(c).Info(fmt.Sprintf("Message %s replies fetched (%d)", messageID, len(messages)))
+    }
+}
+
+// ReactionRequest is the request body for adding a reaction, the user defaults to the authenticated one
+type ReactionRequest struct {
+    Emoji string `json:"emoji"`
+    User  string `json:"user"`
+}
+
+const maxEmojiLength = 32
+
+// validEmoji reports whether the emoji can be used as a reactions key, Mongo field names can't contain dots or start with $
+func validEmoji(emoji string) bool {
+    return emoji != "" && len(emoji) <= maxEmojiLength && !strings.Contains(emoji, ".") && !strings.HasPrefix(emoji, "$")
+}
+
+// reactingUser returns the authenticated user, responding with 401/403 when they're missing or don't match the requested one
+func reactingUser(c *gin.Context, requested string) (string, bool) {
+    user, err := authenticatedUser(c)
+    if err != nil {
+        respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+        loggerFrom(c).Warn("Not authenticated")
+        return "", false
+    }
+    if requested = normalizeName(requested); requested != "" && requested != user {
+        respondError(c, http.StatusForbidden, codeForbidden, "Cannot react on behalf of another user")
+        loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to react as %s", user, requested))
+        return "", false
     }
+    return user, true
 }
 
-// curl -i -X GET http://localhost:8080/messages/64bd837566b7829eaa7ea650
-func getMessageByID(collection *mongo.Collection) func(c *gin.Context) {
+// updateReactions applies the update to the message if user may see it and returns its reactions afterwards
+func updateReactions(ctx context.Context, repo MessageRepository, objectID primitive.ObjectID, user string, update bson.M) (map[string][]string, error) {
+    message, err := repo.Modify(ctx, visibleTo(notDeleted(bson.M{"_id": objectID}), user), update)
+    if message.Reactions == nil {
+        message.Reactions = map[string][]string{}
+    }
+    return message.Reactions, err
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST -H "Content-Type: application/json" -d '{"emoji":"👍"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/reactions
+// @Summary      React to a message
+// @Description  Reacting twice with the same emoji has no further effect
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id        path  string           true  "Message ID (24-character hex)"
+// @Param        reaction  body  ReactionRequest  true  "Emoji to add"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/reactions [post]
+func addReaction(repo MessageRepository) func(c *gin.Context) {
     return func(c *gin.Context) {
 
-        logger.Info(c.Request.URL.Path)
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Parse the reaction from the request body
+        var reaction ReactionRequest
+        if err := c.ShouldBindJSON(&reaction); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        if !validEmoji(reaction.Emoji) {
+            respondError(c, http.StatusBadRequest, codeValidation, "Missing or invalid fields", gin.H{"fields": []string{"emoji"}})
+            loggerFrom(c).Warn("Invalid reaction emoji")
+            return
+        }
+        user, ok := reactingUser(c, reaction.User)
+        if !ok {
+            return
+        }
 
         // Create a context for the database operation
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        ctx, cancel := newDBContext(c)
         defer cancel()
 
-        var message Message
+        // $addToSet keeps a user from reacting twice with the same emoji
+        reactions, err := updateReactions(ctx, repo, objectID, user, bson.M{"$addToSet": bson.M{"reactions." + reaction.Emoji: user}})
+        if err == mongo.ErrNoDocuments {
+            respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
+        if err != nil {
+            respondDBError(c, err, "Failed to add reaction")
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"reactions": reactions})
+        loggerFrom(c).Info(fmt.Sprintf("User %s reacted to message %s", user, messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X DELETE "http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/reactions?emoji=%F0%9F%91%8D"
+// @Summary      Remove a reaction from a message
+// @Tags         messages
+// @Produce      json
+// @Param        id     path   string  true   "Message ID (24-character hex)"
+// @Param        emoji  query  string  true   "Emoji to remove"
+// @Param        user   query  string  false  "Must be the authenticated user when given"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/reactions [delete]
+func removeReaction(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
 
         // Parse the message ID to MongoDB ObjectID
         messageID := c.Param("id")
-        objectID, err := primitive.ObjectIDFromHex(string(messageID))
-        if err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
-            logger.Fatal("Invalid message ID")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // DELETE bodies are dropped by some proxies, so the reaction comes from the query
+        emoji := c.Query("emoji")
+        if !validEmoji(emoji) {
+            respondError(c, http.StatusBadRequest, codeInvalidQuery, "emoji is required")
+            loggerFrom(c).Warn("Invalid reaction emoji")
+            return
+        }
+        user, ok := reactingUser(c, c.Query("user"))
+        if !ok {
             return
         }
 
-        err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&message)
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        field := "reactions." + emoji
+        reactions, err := updateReactions(ctx, repo, objectID, user, bson.M{"$pull": bson.M{field: user}})
+        if err == mongo.ErrNoDocuments {
+            respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+            loggerFrom(c).Warn("Message not found")
+            return
+        }
         if err != nil {
-            if err == mongo.ErrNoDocuments {
-                c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-                logger.Fatal("Message not found")
-            } else {
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find message"})
-                logger.Fatal("Failed to find message")
-            }
+            respondDBError(c, err, "Failed to remove reaction")
             return
         }
-        c.JSON(http.StatusOK, message)
-        logger.Info(fmt.Sprintf("Message %s fetched", messageID))
+
+        // Drop the emoji once nobody reacts with it anymore, unless someone reacted again in the meantime
+        if users, ok := reactions[emoji]; ok && len(users) == 0 {
+            _, err := repo.Modify(ctx, bson.M{"_id": objectID, field: bson.M{"$size": 0}}, bson.M{"$unset": bson.M{field: ""}})
+            if err != nil && err != mongo.ErrNoDocuments {
+                respondDBError(c, err, "Failed to remove reaction")
+                return
+            }
+            delete(reactions, emoji)
+        }
+
+        c.JSON(http.StatusOK, gin.H{"reactions": reactions})
+        loggerFrom(c).Info(fmt.Sprintf("User %s removed a reaction from message %s", user, messageID))
     }
 }
 
-// curl -i -X POST -H "Content-Type: application/json" -d '{"recipient":"Alice","sender":"Bob","content":"Hello, Alice!"}' http://localhost:8080/messages
-func sendMessage(collection *mongo.Collection) func(c *gin.Context) {
+// curl -i -H "Authorization: Bearer $TOKEN" -X PATCH -H "Content-Type: application/json" -d '{"status":"delivered"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/status
+// @Summary      Change a message's delivery status
+// @Tags         messages
+// @Accept       json
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        status  body  StatusUpdate  true  "New status"
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      415  {object} ErrorResponse  "Unsupported Media Type"
+// @Failure      413  {object} ErrorResponse  "Payload Too Large"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      409  {object} ErrorResponse  "Conflict"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/status [patch]
+func updateMessageStatus(repo MessageRepository) func(c *gin.Context) {
     return func(c *gin.Context) {
 
-        logger.Info(c.Request.URL.Path)
-
         // Create a context for the database operation
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        ctx, cancel := newDBContext(c)
         defer cancel()
 
-        // Create a message object from the request body
-        var message Message
-        if err := c.BindJSON(&message); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to decode request body"})
-            logger.Fatal("Failed to decode request body")
+        // Parse the message ID to MongoDB ObjectID
+        messageID := c.Param("id")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        // Parse and validate the requested status
+        var statusUpdate StatusUpdate
+        if err := c.ShouldBindJSON(&statusUpdate); err != nil {
+            respondBindError(c, err)
+            return
+        }
+        if _, ok := statusTransitions[statusUpdate.Status]; !ok {
+            respondError(c, http.StatusBadRequest, codeValidation, "status must be one of sent, delivered, read, failed", gin.H{"fields": []string{"status"}})
+            loggerFrom(c).Warn("Invalid status: " + statusUpdate.Status)
             return
         }
 
-        // Insert the message into the collection
-        result, err := collection.InsertOne(ctx, message)
+        user, err := authenticatedUser(c)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert message"})
-            logger.Fatal("Failed to insert message")
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        // Only move the message if the user may see it and its current status allows the transition
+        set := bson.M{"status": statusUpdate.Status}
+        if statusUpdate.Status == statusRead {
+            set["read"] = true
+        }
+        filter := visibleTo(notDeleted(bson.M{"_id": objectID, "status": bson.M{"$in": statusesAllowingTransitionTo(statusUpdate.Status)}}), user)
+        _, err = repo.Modify(ctx, filter, bson.M{"$set": set})
+        if err != nil && err != mongo.ErrNoDocuments {
+            respondDBError(c, err, "Failed to update message status")
+            return
+        }
+
+        // No match means the message is missing, hidden from the user or in a status that can't make this transition
+        if err == mongo.ErrNoDocuments {
+            count, err := repo.Count(ctx, visibleTo(notDeleted(bson.M{"_id": objectID}), user), ListOptions{})
+            if err != nil {
+                respondDBError(c, err, "Failed to update message status")
+                return
+            }
+            if count == 0 {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+                return
+            }
+            respondError(c, http.StatusConflict, codeInvalidTransition, "Message cannot move to status "+statusUpdate.Status)
+            loggerFrom(c).Warn(fmt.Sprintf("Invalid status transition for message %s to %s", messageID, statusUpdate.Status))
             return
         }
 
-        // Return the ID of the inserted document
-        c.JSON(http.StatusOK, result.InsertedID)
-        logger.Info(fmt.Sprintf("Message %s sent", result.InsertedID))
+        c.JSON(http.StatusOK, gin.H{"message": "Message status updated", "status": statusUpdate.Status})
+        loggerFrom(c).Info(fmt.Sprintf("Message %s status set to %s", messageID, statusUpdate.Status))
     }
 }
 
-// curl -i -X PUT -H "Content-Type: application/json" -d '{"recipient":"Alice","sender":"Bob","content":"Hello, Bob!"}' http://localhost:8080/messages/64bd83ba66b7829eaa7ea651
-func updateMessage(collection *mongo.Collection) func(c *gin.Context) {
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST http://localhost:8080/messages/64bd83ba66b7829eaa7ea651/read
+// @Summary      Mark a message as read
+// @Description  Only the recipient can mark a message as read
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Success      200  {object}  map[string]string
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      409  {object} ErrorResponse  "Conflict"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id}/read [post]
+func markMessageRead(repo MessageRepository) func(c *gin.Context) {
     return func(c *gin.Context) {
 
-        logger.Info(c.Request.URL.Path)
-
         // Create a context for the database operation
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        ctx, cancel := newDBContext(c)
         defer cancel()
 
         // Parse the message ID to MongoDB ObjectID
         messageID := c.Param("id")
-        objectID, err := primitive.ObjectIDFromHex(string(messageID))
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
+            return
+        }
+
+        user, err := authenticatedUser(c)
         if err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
-            logger.Fatal("Invalid message ID")
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
             return
         }
 
-        // Parse the updated message data from the request body
-        var updatedMessage Message
-        if err := c.ShouldBindJSON(&updatedMessage); err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message data"})
-            logger.Fatal("Invalid message data")
+        // Only the recipient reads a message, and reading follows the same transition rules as a status change,
+        // so scheduled and failed messages can't be read, nor can drafts which have no status yet
+        filter := notDraft(notDeleted(bson.M{"_id": objectID, "recipient": user, "status": bson.M{"$in": statusesAllowingTransitionTo(statusRead)}}))
+        _, err = repo.Modify(ctx, filter, bson.M{"$set": bson.M{"read": true, "status": statusRead}})
+        if err != nil && err != mongo.ErrNoDocuments {
+            respondDBError(c, err, "Failed to mark message as read")
+            return
+        }
+
+        // No match means the message is missing, hidden from the user, addressed to someone else or can't move to read
+        if err == mongo.ErrNoDocuments {
+            message, err := repo.GetByID(ctx, objectID)
+            if err == nil && !visibleToUser(message, user) {
+                err = mongo.ErrNoDocuments
+            }
+            if err == mongo.ErrNoDocuments {
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
+                return
+            }
+            if err != nil {
+                respondDBError(c, err, "Failed to mark message as read")
+                return
+            }
+            if message.Recipient != user {
+                respondError(c, http.StatusForbidden, codeForbidden, "Only the recipient can mark a message as read")
+                loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to mark message %s as read", user, messageID))
+                return
+            }
+            respondError(c, http.StatusConflict, codeInvalidTransition, "Message cannot move to status "+statusRead)
+            loggerFrom(c).Warn(fmt.Sprintf("Invalid status transition for message %s to %s", messageID, statusRead))
             return
         }
 
-        // Set the timestamp & ID for the updated message
-        updatedMessage.Timestamp = time.Now()
-        updatedMessage.ID = objectID
+        c.JSON(http.StatusOK, gin.H{"message": "Message marked as read"})
+        loggerFrom(c).Info(fmt.Sprintf("Message %s marked as read", messageID))
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST http://localhost:8080/users/Alice/inbox/read-all
+// @Summary      Mark every message in a user's inbox as read
+// @Description  Only the authenticated user may clear their own inbox
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/inbox/read-all [post]
+func markInboxRead(repo MessageRepository) func(c *gin.Context) {
+    return func(c *gin.Context) {
 
-        // Perform the update by replacing the existing message with the updated message
-        res, err := collection.ReplaceOne(ctx, bson.M{"_id": objectID}, updatedMessage)
+        // Only the recipient may mark their own inbox as read
+        recipient := normalizeName(c.Param("user"))
+        authUser, err := authenticatedUser(c)
         if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
-            logger.Fatal("Failed to update message")
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
             return
         }
-    
-        if res.MatchedCount == 0 {
-            c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-            logger.Fatal("Message not found")
+        if authUser != recipient {
+            respondError(c, http.StatusForbidden, codeForbidden, "Cannot mark another user's inbox as read")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to mark the inbox of %s as read", authUser, recipient))
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        filter := delivered(notDeleted(bson.M{"recipient": recipient, "read": false}))
+        modified, err := repo.ModifyMany(ctx, filter, bson.M{"$set": bson.M{"read": true, "status": statusRead}})
+        if err != nil {
+            respondDBError(c, err, "Failed to mark messages as read")
             return
         }
 
-        c.JSON(http.StatusOK, gin.H{"message": "Message updated successfully", "updatedMessage": updatedMessage})
-        logger.Info(fmt.Sprintf("Message %s updated", messageID))
+        c.JSON(http.StatusOK, gin.H{"message": "Messages marked as read", "modified": modified})
+        loggerFrom(c).Info(fmt.Sprintf("Inbox of %s marked as read (%d)", recipient, modified))
     }
 }
 
-// curl -i -X DELETE http://localhost:8080/messages/64bd85a4caedb30692d69de0
-func deleteMessageById(collection *mongo.Collection) func(c *gin.Context) {
+// curl -i -H "Authorization: Bearer $TOKEN" -X DELETE "http://localhost:8080/messages/64bd85a4caedb30692d69de0?hard=false"
+// @Summary      Delete a message
+// @Tags         messages
+// @Produce      json
+// @Param        id  path  string  true  "Message ID (24-character hex)"
+// @Param        hard  query  bool  false  "Permanently delete instead of soft-deleting"
+// @Success      200  {object}  Message
+// @Failure      400  {object} ErrorResponse  "Bad Request"
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      404  {object} ErrorResponse  "Not Found"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /messages/{id} [delete]
+func deleteMessageById(repo MessageRepository) func(c *gin.Context) {
     return func(c *gin.Context) {
-        
-        logger.Info(c.Request.URL.Path)
 
         // Create a context for the database operation
-        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        ctx, cancel := newDBContext(c)
         defer cancel()
 
-        var message Message
-
         // Parse the message ID to MongoDB ObjectID
         messageID := c.Param("id")
-        objectID, err := primitive.ObjectIDFromHex(string(messageID))
-        if err != nil {
-            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
-            logger.Fatal("Invalid message ID")
+        objectID, ok := parseObjectID(c, "id")
+        if !ok {
             return
         }
 
-        err = collection.FindOneAndDelete(ctx, bson.M{"_id": objectID}).Decode(&message)
+        // Soft-delete by default so the message can be recovered, ?hard=true removes it for good
+        hardDelete := c.Query("hard") == "true"
+        if !checkVisible(ctx, c, repo, objectID) {
+            return
+        }
+        message, err := repo.Delete(ctx, objectID, hardDelete)
         if err != nil {
             if err == mongo.ErrNoDocuments {
-                c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
-                logger.Fatal("Message not found")
+                respondError(c, http.StatusNotFound, codeMessageNotFound, "Message not found")
+                loggerFrom(c).Warn("Message not found")
             } else {
-                c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find message"})
-                logger.Fatal("Failed to find message")
+                respondDBError(c, err, "Failed to find message")
             }
             return
         }
 
         c.JSON(http.StatusOK, message)
-        logger.Info(fmt.Sprintf("Message %s deleted", messageID))
+        if hardDelete {
+            loggerFrom(c).Info(fmt.Sprintf("Message %s permanently deleted", messageID))
+        } else {
+            loggerFrom(c).Info(fmt.Sprintf("Message %s deleted", messageID))
+        }
+    }
+}
+
+// curl -i -X GET http://localhost:8080/health
+// @Summary      Health check
+// @Tags         health
+// @Produce      json
+// @Success      200  {object}  map[string]string
+// @Failure      503  {object}  map[string]string
+// @Router       /health [get]
+func healthCheck(client *mongo.Client) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a short context for the ping
+        ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+        defer cancel()
+
+        if err := client.Ping(ctx, nil); err != nil {
+            c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+            loggerFrom(c).Error("Health check failed: " + err.Error())
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"status": "ok"})
+    }
+}
+
+// curl -i -X GET http://localhost:8080/ready
+// @Summary      Readiness check
+// @Description  Fails until the indexes are built, so the service isn't routed traffic it would serve slowly
+// @Tags         health
+// @Produce      json
+// @Success      200  {object}  map[string]string
+// @Failure      503  {object}  map[string]string
+// @Router       /ready [get]
+func readinessCheck(client *mongo.Client) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        if !indexesReady.Load() {
+            c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": "indexes are still being built"})
+            return
+        }
+
+        // Create a short context for the ping
+        ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+        defer cancel()
+
+        if err := client.Ping(ctx, nil); err != nil {
+            c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": "database unavailable"})
+            loggerFrom(c).Error("Readiness check failed: " + err.Error())
+            return
+        }
+
+        c.JSON(http.StatusOK, gin.H{"status": "ready"})
     }
 }
 
-func loggerSetup() (*zap.Logger, error) {
-    // Logger setup
+func loggerSetup(cfg Config) (*zap.Logger, error) {
+    // Logger setup, production JSON unless running in development or console format is asked for
     loggerConfig := zap.NewProductionConfig()
+    if cfg.Environment == "development" || cfg.LogFormat == "console" {
+        loggerConfig = zap.NewDevelopmentConfig()
+    }
+
+    if cfg.LogLevel != "" {
+        level, err := zap.ParseAtomicLevel(cfg.LogLevel)
+        if err != nil {
+            log.Fatal(err)
+            return nil, err
+        }
+        loggerConfig.Level = level
+    }
+
     loggerConfig.EncoderConfig.TimeKey = "timestamp"
     loggerConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
 
@@ -229,53 +3700,354 @@ func loggerSetup() (*zap.Logger, error) {
     return logger, nil
 }
 
-func setupMongoDB() (*mongo.Collection, error){
-    
-    // Context for MongoDB connection
-    ctx, cancel := context.WithCancel(context.Background())
+// ensureIndexes creates the indexes used by the list queries, existing indexes are left as is
+func ensureIndexes(ctx context.Context, collection *mongo.Collection) error {
+    indexes := []mongo.IndexModel{
+        {Keys: bson.D{{Key: "recipient", Value: 1}, {Key: "timestamp", Value: -1}}},
+        {Keys: bson.D{{Key: "sender", Value: 1}, {Key: "timestamp", Value: -1}}},
+        {Keys: bson.D{{Key: "recipient", Value: 1}, {Key: "read", Value: 1}}},
+        {Keys: bson.D{{Key: "content", Value: "text"}}},
+        {Keys: bson.D{{Key: "replyTo", Value: 1}, {Key: "timestamp", Value: 1}}},
+        {Keys: bson.D{{Key: "labels", Value: 1}, {Key: "timestamp", Value: -1}}},
+        // Only the scheduler queries by deliverAt, and only for messages still waiting
+        {
+            Keys:    bson.D{{Key: "deliverAt", Value: 1}},
+            Options: options.Index().SetPartialFilterExpression(bson.M{"status": statusScheduled}),
+        },
+        // Keys are scoped per sender, messages sent without one are left out of the index
+        {
+            Keys:    bson.D{{Key: "sender", Value: 1}, {Key: "idempotencyKey", Value: 1}},
+            Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"idempotencyKey": bson.M{"$exists": true}}),
+        },
+        // Lets the purge find old soft-deleted messages without scanning live ones
+        {
+            Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+            Options: options.Index().SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": true}}),
+        },
+        // Mongo's TTL monitor runs roughly every 60s, so expired messages may linger that long
+        {Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    }
+
+    names, err := collection.Indexes().CreateMany(ctx, indexes)
+    if err != nil {
+        return err
+    }
+
+    logger.Info("Indexes ensured: " + strings.Join(names, ", "))
+    return nil
+}
+
+// indexesReady is set once ensureIndexes has succeeded, until then the readiness check fails
+var indexesReady atomic.Bool
+
+// buildIndexes runs ensureIndexes in the background, retrying with backoff until it succeeds or ctx is cancelled
+func buildIndexes(ctx context.Context, collection *mongo.Collection) {
+    delay := time.Second
+    for ctx.Err() == nil {
+        // Builds on a large collection can take a while, so there is no timeout beyond shutdown
+        err := ensureIndexes(ctx, collection)
+        if err == nil {
+            indexesReady.Store(true)
+            logger.Info("Setup Complete: MongoDB indexes")
+            return
+        }
+        logger.Error("Failed to create MongoDB indexes: " + err.Error())
+
+        select {
+        case <-ctx.Done():
+        case <-time.After(delay):
+        }
+        if delay < time.Minute {
+            delay *= 2
+        }
+    }
+}
+
+// connectWithRetry connects to and pings MongoDB, backing off exponentially between failed attempts
+func connectWithRetry(clientOptions *options.ClientOptions, maxAttempts int, maxDelay time.Duration) (*mongo.Client, error) {
+    delay := time.Second
+    var err error
+
+    for attempt := 1; attempt <= maxAttempts; attempt++ {
+        var client *mongo.Client
+        client, err = connectOnce(clientOptions)
+        if err == nil {
+            return client, nil
+        }
+
+        logger.Warn(fmt.Sprintf("MongoDB connection attempt %d/%d failed: %s", attempt, maxAttempts, err.Error()))
+        if attempt == maxAttempts {
+            break
+        }
+
+        time.Sleep(delay)
+        delay *= 2
+        if delay > maxDelay {
+            delay = maxDelay
+        }
+    }
+
+    return nil, err
+}
+
+// connectOnce makes a single Connect+Ping attempt, disconnecting again if the ping fails
+func connectOnce(clientOptions *options.ClientOptions) (*mongo.Client, error) {
+
+    // Context bounded to the Connect/Ping phase only, the client outlives it
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
-    
+
     // MongoDB connection
-    connectionString := "mongodb://localhost:27017"
-    client, err := mongo.Connect(ctx, options.Client().ApplyURI(connectionString))
+    client, err := mongo.Connect(ctx, clientOptions)
     if err != nil {
-        fmt.Println("Error connecting to MongoDB:", err)
         return nil, err
     }
 
     // MongoDb Ping
-    err = client.Ping(ctx, nil)
-    if err != nil {
-        fmt.Println("Failed to ping MongoDB:", err)
+    if err := client.Ping(ctx, nil); err != nil {
+        client.Disconnect(ctx)
         return nil, err
     }
 
-    collection := client.Database("Golang").Collection("messages")
+    return client, nil
+}
+
+func setupMongoDB(cfg Config) (*mongo.Client, *mongo.Collection, error){
+
+    // MongoDB connection, retried for databases that are still starting up
+    clientOptions := options.Client().ApplyURI(cfg.MongoURI).SetMaxPoolSize(cfg.MongoMaxPoolSize).SetMinPoolSize(cfg.MongoMinPoolSize)
+    clientOptions.SetMonitor(otelmongo.NewMonitor())
+    readPreference, err := readpref.New(cfg.MongoReadPreference)
+    if err != nil {
+        return nil, nil, err
+    }
+    clientOptions.SetReadPreference(readPreference)
+    logger.Info(fmt.Sprintf("MongoDB connection pool: min %d, max %d", cfg.MongoMinPoolSize, cfg.MongoMaxPoolSize))
+    client, err := connectWithRetry(clientOptions, cfg.MongoConnectAttempts, cfg.MongoConnectMaxDelay)
+    if err != nil {
+        fmt.Println("Error connecting to MongoDB:", err)
+        return nil, nil, err
+    }
+
+    collection := client.Database(cfg.MongoDatabase).Collection(cfg.MongoCollection)
+    return client, collection, nil
+}
+
+// setupRouter registers the middleware and every route, separate from main so the router can be built against any database
+func setupRouter(cfg Config, client *mongo.Client, collection *mongo.Collection, presence *mongo.Collection, hub *Hub, wsHub *wsHub) *gin.Engine {
+    // Every message handler goes through the one repository rather than the collection directly
+    messages := newMongoMessageRepository(collection)
+    limiter := newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, 10*time.Minute)
+
+    router := gin.New()
+    // Panics are recovered inside the request logger and metrics so they are still counted as 500s
+    router.Use(otelgin.Middleware(cfg.ServiceName), requestID(), requestLogger(), recoverPanics(), metricsMiddleware(), corsMiddleware(cfg.CORS), gzipMiddleware(cfg.GzipMinSize), limitBody(cfg.MaxBodyBytes, map[string]int64{"/messages/import": cfg.MaxImportBytes}))
+    router.NoRoute(routeNotFound)
+    router.GET("/health", healthCheck(client))
+    router.GET("/ready", readinessCheck(client))
+    router.GET("/metrics", metricsHandler())
+    router.GET("/docs", func(c *gin.Context) { c.Redirect(http.StatusMovedPermanently, "/docs/index.html") })
+    router.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-    return collection, nil
+    // Every route below is rate limited per client IP, requires a valid bearer token and only accepts JSON bodies
+    api := router.Group("/", limiter.middleware(), authMiddleware(cfg.JWTSecret), requireContentType("application/json"))
+    api.GET("/messages", getMessages(messages))
+    api.GET("/messages/count", getMessageCount(messages))
+    api.GET("/messages/search", searchMessages(messages))
+    api.GET("/messages/export", exportMessages(messages))
+    api.GET("/messages/:id", getMessageByID(messages))
+    api.HEAD("/messages/:id", messageExists(messages))
+    api.POST("/messages", sendMessage(messages, hub))
+    api.POST("/messages/bulk", sendMessagesBulk(messages, hub))
+    api.POST("/messages/batch-get", getMessagesByIDs(messages))
+
+    // Imports are the one body that isn't JSON, so they get their own content type check
+    router.POST("/messages/import", limiter.middleware(), authMiddleware(cfg.JWTSecret), requireContentType("application/x-ndjson"), importMessages(messages))
+    api.PUT("/messages/:id", replaceMessage(messages))
+    api.PATCH("/messages/:id", updateMessage(messages))
+    api.DELETE("/messages/:id", deleteMessageById(messages))
+    api.POST("/messages/:id/read", markMessageRead(messages))
+    api.PATCH("/messages/:id/status", updateMessageStatus(messages))
+    api.PATCH("/messages/:id/content", updateMessageContent(messages))
+    api.PATCH("/messages/:id/recipient", updateMessageRecipient(messages))
+    api.POST("/messages/:id/cancel", cancelScheduledMessage(messages))
+    api.POST("/messages/:id/forward", forwardMessage(messages, hub))
+    api.GET("/messages/:id/history", getMessageHistory(messages))
+    api.GET("/messages/:id/replies", getMessageReplies(messages))
+    api.POST("/messages/:id/reactions", addReaction(messages))
+    api.DELETE("/messages/:id/reactions", removeReaction(messages))
+    api.GET("/conversations", getConversation(messages))
+    api.DELETE("/conversations", deleteConversation(messages))
+    api.GET("/users/:user/inbox", getUserMessages(messages, "recipient"))
+    api.POST("/users/:user/inbox/read-all", markInboxRead(messages))
+    api.GET("/users/:user/sent", getUserMessages(messages, "sender"))
+    api.GET("/users/:user/unread-count", getUnreadCount(messages))
+    api.GET("/users/:user/drafts", getUserDrafts(messages))
+    api.GET("/users/:user/conversations", getUserConversations(messages))
+    api.POST("/users/:user/heartbeat", recordHeartbeat(presence))
+    api.GET("/users/:user/presence", getPresence(presence, cfg.PresenceOnlineThreshold))
+    api.POST("/drafts", createDraft(messages))
+    api.POST("/drafts/:id/send", sendDraft(messages, hub, wsHub))
+    api.GET("/stats/senders", getSenderStats(messages))
+    api.GET("/ws", serveWebSocket(wsHub, cfg.CORS.AllowedOrigins))
+    api.GET("/events", streamEvents(hub))
+
+    // Maintenance routes need a token with the admin role
+    admin := api.Group("/admin", requireAdmin())
+    admin.POST("/purge", purgeDeletedMessages(messages, cfg.SoftDeleteRetention))
+
+    return router
+}
+
+// cleanupTimeout bounds disconnecting from MongoDB and flushing traces once the server has stopped
+const cleanupTimeout = 5 * time.Second
+
+// openConns counts the server's connections so a forced shutdown can report how many it cut off
+var openConns atomic.Int64
+
+// trackConn keeps openConns up to date, hijacked WebSocket connections are no longer the server's to close
+func trackConn(_ net.Conn, state http.ConnState) {
+    switch state {
+    case http.StateNew:
+        openConns.Add(1)
+    case http.StateHijacked, http.StateClosed:
+        openConns.Add(-1)
+    }
 }
 
+// @title                       Messages API
+// @version                     1.0
+// @description                 Send, read and manage messages stored in MongoDB.
+// @BasePath                    /
+// @securityDefinitions.apikey  BearerAuth
+// @in                          header
+// @name                        Authorization
+// @description                 Bearer token, e.g. "Bearer eyJhbGciOi..."
 func main() {
-    // Logger setup
-    logger, err := loggerSetup()
+    // Configuration setup, fails fast before anything else starts
+    cfg, err := loadConfig()
     if err != nil {
-        logger.Fatal("Error setting up logger: " + err.Error())
+        log.Fatal("Invalid configuration: " + err.Error())
+    }
+
+    // Logger setup (assigns the package-level logger used by the handlers)
+    logger, err = loggerSetup(cfg)
+    if err != nil {
+        log.Fatal("Error setting up logger: " + err.Error())
     }
     logger.Info("Setup Complete: Logger")
 
+    // Handler settings
+    dbTimeout = cfg.DBTimeout
+    maxContentLength = cfg.MaxContentLength
+    lowercaseNames = cfg.LowercaseNames
+    messageRetention = cfg.MessageRetention
+    dedupWindow = cfg.DedupWindow
+    editWindow = cfg.EditWindow
+    allowSelfMessages = cfg.AllowSelfMessages
+    recipientQuota = cfg.RecipientQuota
+    recipientQuotaWindow = cfg.RecipientQuotaWindow
+
+    // Tracing setup, before MongoDB so its commands are traced from the first one
+    shutdownTracing, err := setupTracing(context.Background(), cfg)
+    if err != nil {
+        logger.Fatal("Error setting up tracing: " + err.Error())
+    }
+    logger.Info("Setup Complete: Tracing")
+
     // MongoDB setup
-    collection, err := setupMongoDB()
+    client, collection, err := setupMongoDB(cfg)
     if err != nil {
         logger.Fatal("Error setting up MongoDB:" + err.Error())
     }
     logger.Info("Setup Complete: MongoDB")
 
-    router := gin.Default()
-    router.GET("/messages", getMessages(collection))
-    router.GET("/messages/:id", getMessageByID(collection))
-    router.POST("/messages", sendMessage(collection))
-    router.PATCH("/messages/:id", updateMessage(collection))
-    router.DELETE("/messages/:id", deleteMessageById(collection))
+    // Real-time delivery setup, stopped on shutdown
+    watchCtx, stopWatching := context.WithCancel(context.Background())
+    defer stopWatching()
+    wsHub := newWSHub()
+    go watchMessages(watchCtx, collection, wsHub)
+
+    // Index builds run alongside serving, /ready reports not ready until they finish
+    go buildIndexes(watchCtx, collection)
+
+    // Optional mirroring of every mutation to an analytics webhook
+    if cfg.AnalyticsWebhookURL != "" {
+        checkpoints := collection.Database().Collection(cfg.AnalyticsCheckpointCollection)
+        forwarder := newWebhookForwarder(cfg.AnalyticsWebhookURL, cfg.AnalyticsBatchSize, cfg.AnalyticsFlushInterval, checkpoints)
+        go forwarder.run(watchCtx, collection)
+        logger.Info("Setup Complete: Analytics webhook")
+    }
+
+    // In-process notifications for sent messages
+    hub := newHub()
+
+    // Scheduled messages are delivered by polling, stopped on shutdown
+    go runScheduler(watchCtx, collection, cfg.SchedulePollInterval, hub, wsHub)
+
+    // Release mode keeps the route dump and debug warnings out of production logs
+    gin.SetMode(cfg.GinMode)
+
+    // Presence lives next to the messages in the same database
+    presence := collection.Database().Collection(cfg.PresenceCollection)
+
+    router := setupRouter(cfg, client, collection, presence, hub, wsHub)
+
+    server := &http.Server{
+        Addr:      cfg.ListenAddr,
+        Handler:   router,
+        ConnState: trackConn,
+    }
+
+    // Serve in the background so we can listen for shutdown signals, over HTTPS when a certificate is configured
+    go func() {
+        var err error
+        if cfg.TLSCertFile != "" {
+            err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+        } else {
+            err = server.ListenAndServe()
+        }
+        if err != nil && !errors.Is(err, http.ErrServerClosed) {
+            logger.Fatal("Error starting server: " + err.Error())
+        }
+    }()
+    if cfg.TLSCertFile != "" {
+        logger.Info("Server listening with TLS on " + server.Addr)
+    } else {
+        logger.Info("Server listening on " + server.Addr)
+    }
+
+    // Wait for SIGINT/SIGTERM
+    quit := make(chan os.Signal, 1)
+    signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+    <-quit
+    logger.Info("Shutting down server")
+    stopWatching()
+
+    // Let in-flight requests finish before closing
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+    defer cancel()
 
-    router.Run("localhost:8080")
-}
\ No newline at end of file
+    if err := server.Shutdown(ctx); errors.Is(err, context.DeadlineExceeded) {
+        // Requests still running when the window ends are cut off
+        logger.Warn(fmt.Sprintf("Shutdown timed out after %s, force closing %d open connections", cfg.ShutdownTimeout, openConns.Load()))
+        if err := server.Close(); err != nil {
+            logger.Error("Error closing server: " + err.Error())
+        }
+    } else if err != nil {
+        logger.Error("Error shutting down server: " + err.Error())
+    }
+
+    // Cleanup gets its own window, the shutdown one may already have run out on a forced close
+    cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), cleanupTimeout)
+    defer cleanupCancel()
+
+    if err := client.Disconnect(cleanupCtx); err != nil {
+        logger.Error("Error disconnecting from MongoDB: " + err.Error())
+    }
+
+    if err := shutdownTracing(cleanupCtx); err != nil {
+        logger.Error("Error flushing traces: " + err.Error())
+    }
+    logger.Info("Shutdown Complete")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+    httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "http_requests_total",
+        Help: "Total number of HTTP requests by route and status.",
+    }, []string{"method", "route", "status"})
+
+    httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "http_request_duration_seconds",
+        Help:    "HTTP request latency by route.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method", "route"})
+)
+
+// metricsMiddleware records a request count and latency for every handled route
+func metricsMiddleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        c.Next()
+
+        // Use the route template so IDs don't explode the label cardinality
+        route := c.FullPath()
+        if route == "" {
+            route = "unmatched"
+        }
+
+        status := strconv.Itoa(c.Writer.Status())
+        httpRequestsTotal.WithLabelValues(c.Request.Method, route, status).Inc()
+        httpRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+    }
+}
+
+// curl -i -X GET http://localhost:8080/metrics
+func metricsHandler() gin.HandlerFunc {
+    return gin.WrapH(promhttp.Handler())
+}
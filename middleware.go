@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// requestLogger writes one structured access log line per request once it completes
+func requestLogger() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        c.Next()
+
+        loggerFrom(c).Info("Request handled",
+            zap.String("method", c.Request.Method),
+            zap.String("path", c.Request.URL.Path),
+            zap.Int("status", c.Writer.Status()),
+            zap.Duration("latency", time.Since(start)),
+            zap.String("clientIP", c.ClientIP()),
+        )
+    }
+}
+
+// recoverPanics turns a panicking handler into a JSON 500, logging the panic and its stack
+func recoverPanics() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        defer func() {
+            recovered := recover()
+            if recovered == nil {
+                return
+            }
+            // The standard library uses this panic to abort a response on purpose
+            if recovered == http.ErrAbortHandler {
+                panic(recovered)
+            }
+
+            loggerFrom(c).Error("Handler panicked",
+                zap.Any("panic", recovered),
+                zap.String("method", c.Request.Method),
+                zap.String("path", c.Request.URL.Path),
+                zap.Stack("stack"),
+            )
+
+            // Part of the response may already be on the wire, in which case all that's left is to stop
+            if c.Writer.Written() {
+                c.Abort()
+                return
+            }
+            respondError(c, http.StatusInternalServerError, codeInternal, "Internal server error")
+        }()
+        c.Next()
+    }
+}
+
+// corsConfig lists what cross-origin browser clients are allowed to do
+type corsConfig struct {
+    AllowedOrigins []string
+    AllowedMethods []string
+    AllowedHeaders []string
+    // MaxAge is how long browsers may cache a preflight response
+    MaxAge time.Duration
+}
+
+// corsMiddleware sets the Access-Control-Allow-* headers for allowlisted origins and answers preflights
+func corsMiddleware(config corsConfig) gin.HandlerFunc {
+    allowedOrigins := map[string]bool{}
+    for _, origin := range config.AllowedOrigins {
+        allowedOrigins[origin] = true
+    }
+    allowedMethods := strings.Join(config.AllowedMethods, ", ")
+    allowedHeaders := strings.Join(config.AllowedHeaders, ", ")
+    maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+    return func(c *gin.Context) {
+        origin := c.GetHeader("Origin")
+        if origin == "" {
+            c.Next()
+            return
+        }
+
+        c.Header("Vary", "Origin")
+        if !allowedOrigins[origin] {
+            if c.Request.Method == http.MethodOptions {
+                c.AbortWithStatus(http.StatusForbidden)
+                loggerFrom(c).Warn("CORS origin not allowed: " + origin)
+                return
+            }
+            c.Next()
+            return
+        }
+
+        c.Header("Access-Control-Allow-Origin", origin)
+        c.Header("Access-Control-Allow-Methods", allowedMethods)
+        c.Header("Access-Control-Allow-Headers", allowedHeaders)
+
+        if c.Request.Method == http.MethodOptions {
+            c.Header("Access-Control-Max-Age", maxAge)
+            c.AbortWithStatus(http.StatusNoContent)
+            return
+        }
+        c.Next()
+    }
+}
+
+// requireContentType answers 415 when a request carries a body of another content type, bodiless requests pass through
+func requireContentType(contentType string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        method := c.Request.Method
+        hasBody := c.Request.ContentLength > 0 || len(c.Request.TransferEncoding) > 0
+        if (method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch) && hasBody && c.ContentType() != contentType {
+            respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedMedia, "Content-Type must be "+contentType, gin.H{"contentType": c.ContentType()})
+            loggerFrom(c).Warn("Unsupported Content-Type: " + c.ContentType())
+            return
+        }
+        c.Next()
+    }
+}
+
+// limitBody caps request bodies at maxBytes, or the route's entry in overrides, rejecting a declared oversize body upfront and failing reads past the cap otherwise
+func limitBody(maxBytes int64, overrides map[string]int64) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        maxBytes := maxBytes
+        if override, ok := overrides[c.FullPath()]; ok {
+            maxBytes = override
+        }
+        if c.Request.ContentLength > maxBytes {
+            respondPayloadTooLarge(c, maxBytes)
+            return
+        }
+        c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+        c.Next()
+    }
+}
+
+// splitList splits a comma-separated list, dropping blank entries
+func splitList(value string) []string {
+    items := []string{}
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+const (
+    requestIDHeader     = "X-Request-ID"
+    requestIDContextKey = "requestID"
+    loggerContextKey    = "logger"
+)
+
+// requestID reads or generates a request ID, echoes it back and attaches it to every log line for the request
+func requestID() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        id := c.GetHeader(requestIDHeader)
+        if id == "" {
+            id = newRequestID()
+        }
+
+        c.Set(requestIDContextKey, id)
+        c.Set(loggerContextKey, logger.With(zap.String("requestID", id)))
+        c.Header(requestIDHeader, id)
+        c.Next()
+    }
+}
+
+// newRequestID returns a random 16-byte hex ID
+func newRequestID() string {
+    bytes := make([]byte, 16)
+    if _, err := rand.Read(bytes); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
+    }
+    return hex.EncodeToString(bytes)
+}
+
+// loggerFrom returns the request-scoped logger, falling back to the package logger outside a request
+func loggerFrom(c *gin.Context) *zap.Logger {
+    if value, ok := c.Get(loggerContextKey); ok {
+        if requestLog, ok := value.(*zap.Logger); ok {
+            return requestLog
+        }
+    }
+    return logger
+}
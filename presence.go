@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Presence is when a user last sent a heartbeat, and whether that was recent enough to count as online
+type Presence struct {
+    User     string     `bson:"_id" json:"user"`
+    LastSeen *time.Time `bson:"lastSeen" json:"lastSeen"`
+    Online   bool       `bson:"-" json:"online"`
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X POST http://localhost:8080/users/Alice/heartbeat
+// @Summary      Record that a user is active
+// @Description  Users can only send heartbeats for themselves
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Success      200  {object}  Presence
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      403  {object} ErrorResponse  "Forbidden"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/heartbeat [post]
+func recordHeartbeat(presence *mongo.Collection) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Only the user themselves can report being active
+        user := normalizeName(c.Param("user"))
+        authUser, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+        if authUser != user {
+            respondError(c, http.StatusForbidden, codeForbidden, "Cannot send a heartbeat for another user")
+            loggerFrom(c).Warn(fmt.Sprintf("User %s attempted to send a heartbeat for %s", authUser, user))
+            return
+        }
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // One document per user, created on their first heartbeat
+        now := time.Now().UTC()
+        update := bson.M{"$set": bson.M{"lastSeen": now}}
+        if _, err := presence.UpdateOne(ctx, bson.M{"_id": user}, update, options.Update().SetUpsert(true)); err != nil {
+            respondDBError(c, err, "Failed to record heartbeat")
+            return
+        }
+
+        c.JSON(http.StatusOK, Presence{User: user, LastSeen: &now, Online: true})
+        loggerFrom(c).Info("Heartbeat recorded for " + user)
+    }
+}
+
+// curl -i -H "Authorization: Bearer $TOKEN" -X GET http://localhost:8080/users/Alice/presence
+// @Summary      Get when a user was last active
+// @Description  lastSeen is null for users who never sent a heartbeat
+// @Tags         users
+// @Produce      json
+// @Param        user  path  string  true  "User name"
+// @Success      200  {object}  Presence
+// @Failure      401  {object} ErrorResponse  "Unauthorized"
+// @Failure      429  {object} ErrorResponse  "Too Many Requests"
+// @Failure      500  {object} ErrorResponse  "Internal Server Error"
+// @Failure      503  {object} ErrorResponse  "Service Unavailable"
+// @Security     BearerAuth
+// @Router       /users/{user}/presence [get]
+func getPresence(presence *mongo.Collection, onlineThreshold time.Duration) func(c *gin.Context) {
+    return func(c *gin.Context) {
+
+        // Create a context for the database operation
+        ctx, cancel := newDBContext(c)
+        defer cancel()
+
+        // A user who never sent a heartbeat is simply offline
+        user := normalizeName(c.Param("user"))
+        status := Presence{User: user}
+        err := presence.FindOne(ctx, bson.M{"_id": user}).Decode(&status)
+        if err != nil && err != mongo.ErrNoDocuments {
+            respondDBError(c, err, "Failed to retrieve presence")
+            return
+        }
+        status.Online = status.LastSeen != nil && time.Since(*status.LastSeen) <= onlineThreshold
+
+        c.JSON(http.StatusOK, status)
+        loggerFrom(c).Info(fmt.Sprintf("Presence of %s retrieved", user))
+    }
+}
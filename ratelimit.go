@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// ipLimiter is the token bucket for a single client IP
+type ipLimiter struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// rateLimiter hands out a token bucket per client IP and forgets idle ones
+type rateLimiter struct {
+    mu       sync.Mutex
+    limiters map[string]*ipLimiter
+    rps      rate.Limit
+    burst    int
+}
+
+func newRateLimiter(rps float64, burst int, idleTimeout time.Duration) *rateLimiter {
+    rl := &rateLimiter{
+        limiters: map[string]*ipLimiter{},
+        rps:      rate.Limit(rps),
+        burst:    burst,
+    }
+    go rl.cleanup(idleTimeout)
+    return rl
+}
+
+// get returns the bucket for the IP, creating it on first use
+func (rl *rateLimiter) get(ip string) *rate.Limiter {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+
+    entry, ok := rl.limiters[ip]
+    if !ok {
+        entry = &ipLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
+        rl.limiters[ip] = entry
+    }
+    entry.lastSeen = time.Now()
+    return entry.limiter
+}
+
+// cleanup periodically drops buckets that have been idle longer than idleTimeout
+func (rl *rateLimiter) cleanup(idleTimeout time.Duration) {
+    ticker := time.NewTicker(idleTimeout)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        rl.mu.Lock()
+        for ip, entry := range rl.limiters {
+            if time.Since(entry.lastSeen) > idleTimeout {
+                delete(rl.limiters, ip)
+            }
+        }
+        rl.mu.Unlock()
+    }
+}
+
+// middleware rejects requests over the limit with 429 and a Retry-After header
+func (rl *rateLimiter) middleware() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        reservation := rl.get(c.ClientIP()).Reserve()
+        if delay := reservation.Delay(); delay > 0 {
+            reservation.Cancel()
+            c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+            respondError(c, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+            loggerFrom(c).Warn("Rate limit exceeded for " + c.ClientIP())
+            return
+        }
+        c.Next()
+    }
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// errVersionConflict is returned by Update when the message exists but the expected version no longer matches
+var errVersionConflict = errors.New("message was modified by another request")
+
+// ListOptions controls the order and page of a List call
+type ListOptions struct {
+    Sort   bson.D
+    Limit  int64
+    Offset int64
+    // CountTotal also counts every match, otherwise the returned total is 0
+    CountTotal bool
+    // Projection limits the fields loaded, nil loads whole messages
+    Projection bson.M
+    // ReadPreference overrides the client's read preference, e.g. to read from a secondary
+    ReadPreference *readpref.ReadPref
+}
+
+// MessageRepository is the message storage the core handlers depend on, missing messages are reported as mongo.ErrNoDocuments
+type MessageRepository interface {
+    // Create stores a new message, or returns the original and false when its idempotency key was already used by the sender
+    Create(ctx context.Context, message Message) (Message, bool, error)
+    GetByID(ctx context.Context, id primitive.ObjectID) (Message, error)
+    List(ctx context.Context, filter bson.M, opts ListOptions) ([]Message, int64, error)
+    // Each calls fn with every message List would return as it is read, stopping at fn's first error, CountTotal is ignored
+    Each(ctx context.Context, filter bson.M, opts ListOptions, fn func(Message) error) error
+    // Update sets the given fields and records the prior version in the history, version is optional
+    Update(ctx context.Context, id primitive.ObjectID, fields bson.M, version *int) (Message, error)
+    // Delete soft-deletes the message unless hard is set, returning it as it was last stored
+    Delete(ctx context.Context, id primitive.ObjectID, hard bool) (Message, error)
+    // Count returns how many messages match the filter, only Limit and ReadPreference of opts apply
+    Count(ctx context.Context, filter bson.M, opts ListOptions) (int64, error)
+    // CreateMany stores the messages unordered, a mongo.BulkWriteException reports the ones that failed by index
+    CreateMany(ctx context.Context, messages []Message) error
+    // Replace swaps the message for replacement, recording the prior version and keeping the fields only the server sets
+    Replace(ctx context.Context, id primitive.ObjectID, replacement Message) (Message, error)
+    // Modify applies a raw update to the first message matching the filter and returns it afterwards
+    Modify(ctx context.Context, filter bson.M, update interface{}) (Message, error)
+    // ModifyMany applies a raw update to every message matching the filter, returning how many changed
+    ModifyMany(ctx context.Context, filter bson.M, update bson.M) (int64, error)
+    // DeleteMany permanently removes every message matching the filter, returning how many were removed
+    DeleteMany(ctx context.Context, filter bson.M) (int64, error)
+    // Aggregate runs the pipeline and decodes every result into results, a pointer to a slice
+    Aggregate(ctx context.Context, pipeline mongo.Pipeline, results interface{}) error
+}
+
+// mongoMessageRepository is the MessageRepository backed by a MongoDB collection
+type mongoMessageRepository struct {
+    collection *mongo.Collection
+}
+
+func newMongoMessageRepository(collection *mongo.Collection) *mongoMessageRepository {
+    return &mongoMessageRepository{collection: collection}
+}
+
+func (r *mongoMessageRepository) Create(ctx context.Context, message Message) (Message, bool, error) {
+    result, err := r.collection.InsertOne(ctx, message)
+    if err != nil && message.IdempotencyKey != "" && mongo.IsDuplicateKeyError(err) {
+        var original Message
+        err := r.collection.FindOne(ctx, bson.M{"sender": message.Sender, "idempotencyKey": message.IdempotencyKey}).Decode(&original)
+        return original, false, err
+    }
+    if err != nil {
+        return Message{}, false, err
+    }
+
+    if insertedID, ok := result.InsertedID.(primitive.ObjectID); ok {
+        message.ID = insertedID
+    }
+    return message, true, nil
+}
+
+func (r *mongoMessageRepository) GetByID(ctx context.Context, id primitive.ObjectID) (Message, error) {
+    var message Message
+    err := r.collection.FindOne(ctx, notDeleted(bson.M{"_id": id})).Decode(&message)
+    return message, err
+}
+
+func (r *mongoMessageRepository) List(ctx context.Context, filter bson.M, opts ListOptions) ([]Message, int64, error) {
+    collection := withReadPreference(r.collection, opts.ReadPreference)
+
+    // Fetch the page and total in one round-trip when the total is wanted
+    if opts.CountTotal {
+        return findMessagePage(ctx, collection, filter, opts.Sort, opts.Limit, opts.Offset, opts.Projection)
+    }
+
+    messages, err := findMessages(ctx, collection, filter, listFindOptions(opts))
+    return messages, 0, err
+}
+
+func (r *mongoMessageRepository) Each(ctx context.Context, filter bson.M, opts ListOptions, fn func(Message) error) error {
+    cursor, err := withReadPreference(r.collection, opts.ReadPreference).Find(ctx, filter, listFindOptions(opts))
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+
+    for cursor.Next(ctx) {
+        var message Message
+        if err := cursor.Decode(&message); err != nil {
+            return err
+        }
+        if err := fn(message); err != nil {
+            return err
+        }
+    }
+    return cursor.Err()
+}
+
+// listFindOptions turns the page described by opts into find options
+func listFindOptions(opts ListOptions) *options.FindOptions {
+    findOptions := options.Find().SetLimit(opts.Limit).SetSkip(opts.Offset)
+    if opts.Sort != nil {
+        findOptions.SetSort(opts.Sort)
+    }
+    if opts.Projection != nil {
+        findOptions.SetProjection(opts.Projection)
+    }
+    return findOptions
+}
+
+func (r *mongoMessageRepository) Update(ctx context.Context, id primitive.ObjectID, fields bson.M, version *int) (Message, error) {
+    // Record when the message was edited, the creation timestamp stays as is
+    now := time.Now()
+    fields["updatedAt"] = now
+
+    // When the caller sends the version it last saw, only update if nobody changed it since
+    filter := notDeleted(bson.M{"_id": id})
+    if version != nil {
+        if *version == 0 {
+            filter["version"] = bson.M{"$in": bson.A{0, nil}}
+        } else {
+            filter["version"] = *version
+        }
+    }
+
+    var message Message
+    updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err := r.collection.FindOneAndUpdate(ctx, filter, updateWithHistory(fields, now), updateOptions).Decode(&message)
+    if err != mongo.ErrNoDocuments || version == nil {
+        return message, err
+    }
+
+    // Tell a version mismatch apart from a missing message
+    count, err := r.collection.CountDocuments(ctx, notDeleted(bson.M{"_id": id}))
+    if err != nil {
+        return Message{}, err
+    }
+    if count == 0 {
+        return Message{}, mongo.ErrNoDocuments
+    }
+    return Message{}, errVersionConflict
+}
+
+func (r *mongoMessageRepository) Delete(ctx context.Context, id primitive.ObjectID, hard bool) (Message, error) {
+    var message Message
+    if hard {
+        err := r.collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&message)
+        return message, err
+    }
+
+    update := bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}}
+    updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err := r.collection.FindOneAndUpdate(ctx, notDeleted(bson.M{"_id": id}), update, updateOptions).Decode(&message)
+    return message, err
+}
+
+func (r *mongoMessageRepository) Count(ctx context.Context, filter bson.M, opts ListOptions) (int64, error) {
+    countOptions := options.Count()
+    if opts.Limit > 0 {
+        countOptions.SetLimit(opts.Limit)
+    }
+    return countMessages(ctx, withReadPreference(r.collection, opts.ReadPreference), filter, countOptions)
+}
+
+func (r *mongoMessageRepository) CreateMany(ctx context.Context, messages []Message) error {
+    documents := make([]interface{}, len(messages))
+    for i, message := range messages {
+        documents[i] = message
+    }
+    _, err := r.collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+    return err
+}
+
+func (r *mongoMessageRepository) Replace(ctx context.Context, id primitive.ObjectID, replacement Message) (Message, error) {
+    now := time.Now()
+    replacement.ID = id
+    replacement.UpdatedAt = now
+    replacement.History = nil
+    // The status only changes through its transitions and a scheduled delivery time is fixed, the stored ones are kept
+    replacement.Status = ""
+    replacement.DeliverAt = nil
+
+    var message Message
+    updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err := r.collection.FindOneAndUpdate(ctx, notDeleted(bson.M{"_id": id}), replaceWithHistory(replacement, now), updateOptions).Decode(&message)
+    return message, err
+}
+
+func (r *mongoMessageRepository) Modify(ctx context.Context, filter bson.M, update interface{}) (Message, error) {
+    var message Message
+    updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+    err := r.collection.FindOneAndUpdate(ctx, filter, update, updateOptions).Decode(&message)
+    return message, err
+}
+
+func (r *mongoMessageRepository) ModifyMany(ctx context.Context, filter bson.M, update bson.M) (int64, error) {
+    res, err := r.collection.UpdateMany(ctx, filter, update)
+    if err != nil {
+        return 0, err
+    }
+    return res.ModifiedCount, nil
+}
+
+func (r *mongoMessageRepository) DeleteMany(ctx context.Context, filter bson.M) (int64, error) {
+    res, err := r.collection.DeleteMany(ctx, filter)
+    if err != nil {
+        return 0, err
+    }
+    return res.DeletedCount, nil
+}
+
+func (r *mongoMessageRepository) Aggregate(ctx context.Context, pipeline mongo.Pipeline, results interface{}) error {
+    cursor, err := r.collection.Aggregate(ctx, pipeline)
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+    return cursor.All(ctx, results)
+}
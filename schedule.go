@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deliverDueMessages moves every scheduled message whose deliverAt has passed to sent, one at a time so a
+// message cancelled meanwhile is never delivered
+func deliverDueMessages(ctx context.Context, collection *mongo.Collection, hub *Hub, wsHub *wsHub) (int, error) {
+    count := 0
+    due := notDeleted(bson.M{"status": statusScheduled, "deliverAt": bson.M{"$lte": time.Now().UTC()}})
+
+    for {
+        // The timestamp becomes the delivery time so the message sorts where the recipient first sees it
+        update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"status": statusSent, "timestamp": "$deliverAt"}}}}
+        updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+        var message Message
+        err := collection.FindOneAndUpdate(ctx, due, update, updateOptions).Decode(&message)
+        if err == mongo.ErrNoDocuments {
+            return count, nil
+        }
+        if err != nil {
+            return count, err
+        }
+
+        count++
+        hub.Publish(message)
+        wsHub.broadcast(message)
+    }
+}
+
+// runScheduler polls for scheduled messages that are due every interval until ctx is cancelled
+func runScheduler(ctx context.Context, collection *mongo.Collection, interval time.Duration, hub *Hub, wsHub *wsHub) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        count, err := deliverDueMessages(ctx, collection, hub, wsHub)
+        if err != nil && ctx.Err() == nil {
+            logger.Error("Failed to deliver scheduled messages: " + err.Error())
+        }
+        if count > 0 {
+            logger.Info(fmt.Sprintf("Scheduled messages delivered (%d)", count))
+        }
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// setupTracing exports spans over OTLP/HTTP when an endpoint is configured, returning a function that flushes them on shutdown
+func setupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+    // Trace context from the mesh is honoured even when this service doesn't export spans itself
+    otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+    if cfg.TracingEndpoint == "" {
+        return func(context.Context) error { return nil }, nil
+    }
+
+    // The exporter reads OTEL_EXPORTER_OTLP_ENDPOINT and the other standard OTEL_EXPORTER_OTLP_* variables itself
+    exporter, err := otlptracehttp.New(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+    if err != nil {
+        return nil, err
+    }
+
+    provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+    otel.SetTracerProvider(provider)
+    return provider.Shutdown, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// checkpointID identifies the analytics resume token in the checkpoints collection
+const checkpointID = "analytics"
+
+// changeEvent is the part of a change stream event forwarded to the analytics webhook
+type changeEvent struct {
+    OperationType string `bson:"operationType" json:"operationType"`
+    DocumentKey   struct {
+        ID primitive.ObjectID `bson:"_id" json:"id"`
+    } `bson:"documentKey" json:"documentKey"`
+    FullDocument      *Message `bson:"fullDocument,omitempty" json:"fullDocument,omitempty"`
+    UpdateDescription bson.M   `bson:"updateDescription,omitempty" json:"updateDescription,omitempty"`
+}
+
+// webhookForwarder batches change events and POSTs them to an external URL
+type webhookForwarder struct {
+    url           string
+    batchSize     int
+    flushInterval time.Duration
+    client        *http.Client
+    checkpoints   *mongo.Collection
+}
+
+func newWebhookForwarder(url string, batchSize int, flushInterval time.Duration, checkpoints *mongo.Collection) *webhookForwarder {
+    return &webhookForwarder{
+        url:           url,
+        batchSize:     batchSize,
+        flushInterval: flushInterval,
+        client:        &http.Client{Timeout: 10 * time.Second},
+        checkpoints:   checkpoints,
+    }
+}
+
+// loadResumeToken returns the token after the last delivered batch, or nil when nothing was delivered yet
+func (f *webhookForwarder) loadResumeToken(ctx context.Context) (bson.Raw, error) {
+    var checkpoint struct {
+        ResumeToken bson.Raw `bson:"resumeToken"`
+    }
+    err := f.checkpoints.FindOne(ctx, bson.M{"_id": checkpointID}).Decode(&checkpoint)
+    if err == mongo.ErrNoDocuments {
+        return nil, nil
+    }
+    return checkpoint.ResumeToken, err
+}
+
+func (f *webhookForwarder) saveResumeToken(ctx context.Context, token bson.Raw) error {
+    update := bson.M{"$set": bson.M{"resumeToken": token, "updatedAt": time.Now().UTC()}}
+    _, err := f.checkpoints.UpdateOne(ctx, bson.M{"_id": checkpointID}, update, options.Update().SetUpsert(true))
+    return err
+}
+
+// post sends one batch, any non-2xx response counts as a failure
+func (f *webhookForwarder) post(ctx context.Context, events []changeEvent) error {
+    body, err := json.Marshal(gin.H{"events": events})
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    res, err := f.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode < 200 || res.StatusCode > 299 {
+        return fmt.Errorf("webhook responded with %d", res.StatusCode)
+    }
+    return nil
+}
+
+// deliver retries the batch with backoff until it is accepted, then checkpoints past it so it is never skipped
+func (f *webhookForwarder) deliver(ctx context.Context, events []changeEvent, token bson.Raw) error {
+    delay := time.Second
+    for {
+        err := f.post(ctx, events)
+        if err == nil {
+            break
+        }
+        logger.Warn(fmt.Sprintf("Failed to deliver %d change events, retrying in %s: %s", len(events), delay, err.Error()))
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(delay):
+        }
+        if delay < time.Minute {
+            delay *= 2
+        }
+    }
+
+    logger.Info(fmt.Sprintf("Delivered %d change events", len(events)))
+    return f.saveResumeToken(ctx, token)
+}
+
+// forward streams every mutation into batches, flushing on size or age, until the stream fails or ctx is cancelled
+func (f *webhookForwarder) forward(ctx context.Context, stream *mongo.ChangeStream) error {
+    var batch []changeEvent
+    var token bson.Raw
+    var batchStarted time.Time
+
+    for {
+        if stream.TryNext(ctx) {
+            var event changeEvent
+            if err := stream.Decode(&event); err != nil {
+                logger.Error("Failed to decode change event: " + err.Error())
+            } else {
+                if len(batch) == 0 {
+                    batchStarted = time.Now()
+                }
+                batch = append(batch, event)
+            }
+            token = stream.ResumeToken()
+        } else if err := stream.Err(); err != nil {
+            return err
+        }
+
+        if len(batch) == 0 || (len(batch) < f.batchSize && time.Since(batchStarted) < f.flushInterval) {
+            continue
+        }
+        if err := f.deliver(ctx, batch, token); err != nil {
+            return err
+        }
+        batch = nil
+    }
+}
+
+// run reopens the change stream from the last checkpoint until ctx is cancelled, so restarts don't miss events
+func (f *webhookForwarder) run(ctx context.Context, collection *mongo.Collection) {
+    delay := time.Second
+
+    for ctx.Err() == nil {
+        token, err := f.loadResumeToken(ctx)
+        if err != nil {
+            logger.Error("Failed to load analytics resume token: " + err.Error())
+        } else {
+            // Updates carry the whole document, and getMore returns at least once a second so partial batches still flush
+            streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup).SetMaxAwaitTime(time.Second)
+            if token != nil {
+                streamOptions.SetStartAfter(token)
+            }
+
+            stream, err := collection.Watch(ctx, mongo.Pipeline{}, streamOptions)
+            if err != nil {
+                logger.Error("Failed to open analytics change stream: " + err.Error())
+            } else {
+                delay = time.Second
+                if err := f.forward(ctx, stream); err != nil && ctx.Err() == nil {
+                    logger.Error("Analytics change stream closed: " + err.Error())
+                }
+                stream.Close(context.Background())
+            }
+        }
+
+        // Back off before reopening the stream
+        select {
+        case <-ctx.Done():
+        case <-time.After(delay):
+        }
+        if delay < time.Minute {
+            delay *= 2
+        }
+    }
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    wsWriteTimeout = 10 * time.Second
+    wsSendBuffer   = 16
+)
+
+// wsClient is a connected WebSocket subscriber waiting for messages to a recipient
+type wsClient struct {
+    recipient string
+    send      chan Message
+}
+
+// wsHub fans out newly inserted messages to the clients subscribed to their recipient
+type wsHub struct {
+    mu      sync.RWMutex
+    clients map[string]map[*wsClient]bool
+}
+
+func newWSHub() *wsHub {
+    return &wsHub{clients: map[string]map[*wsClient]bool{}}
+}
+
+func (h *wsHub) register(client *wsClient) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if h.clients[client.recipient] == nil {
+        h.clients[client.recipient] = map[*wsClient]bool{}
+    }
+    h.clients[client.recipient][client] = true
+}
+
+func (h *wsHub) unregister(client *wsClient) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if subscribers, ok := h.clients[client.recipient]; ok {
+        delete(subscribers, client)
+        if len(subscribers) == 0 {
+            delete(h.clients, client.recipient)
+        }
+    }
+}
+
+// broadcast delivers the message to its recipient's subscribers, skipping any that are backed up
+func (h *wsHub) broadcast(message Message) {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    for client := range h.clients[message.Recipient] {
+        select {
+        case client.send <- message:
+        default:
+            logger.Warn("Dropping message for slow WebSocket client " + client.recipient)
+        }
+    }
+}
+
+// watchMessages streams inserts from the collection into the hub until ctx is cancelled
+func watchMessages(ctx context.Context, collection *mongo.Collection, hub *wsHub) {
+    pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}}}}}
+    delay := time.Second
+
+    for ctx.Err() == nil {
+        stream, err := collection.Watch(ctx, pipeline, options.ChangeStream())
+        if err != nil {
+            logger.Error("Failed to open change stream: " + err.Error())
+        } else {
+            delay = time.Second
+            for stream.Next(ctx) {
+                var event struct {
+                    FullDocument Message `bson:"fullDocument"`
+                }
+                if err := stream.Decode(&event); err != nil {
+                    logger.Error("Failed to decode change event: " + err.Error())
+                    continue
+                }
+                // Scheduled messages and drafts are broadcast once they are actually sent
+                if event.FullDocument.Status == statusScheduled || event.FullDocument.Draft {
+                    continue
+                }
+                hub.broadcast(event.FullDocument)
+            }
+            if err := stream.Err(); err != nil && ctx.Err() == nil {
+                logger.Error("Change stream closed: " + err.Error())
+            }
+            stream.Close(context.Background())
+        }
+
+        // Back off before reopening the stream
+        select {
+        case <-ctx.Done():
+        case <-time.After(delay):
+        }
+        if delay < time.Minute {
+            delay *= 2
+        }
+    }
+}
+
+// wsSubscription is the first frame a client sends after connecting
+type wsSubscription struct {
+    Recipient string `json:"recipient"`
+}
+
+// websocat -H "Authorization: Bearer $TOKEN" ws://localhost:8080/ws  then send {"recipient":"Alice"}
+func serveWebSocket(hub *wsHub, allowedOrigins []string) func(c *gin.Context) {
+    origins := map[string]bool{}
+    for _, origin := range allowedOrigins {
+        origins[origin] = true
+    }
+    upgrader := websocket.Upgrader{
+        CheckOrigin: func(r *http.Request) bool {
+            origin := r.Header.Get("Origin")
+            return origin == "" || origins[origin]
+        },
+    }
+
+    return func(c *gin.Context) {
+
+        user, err := authenticatedUser(c)
+        if err != nil {
+            respondError(c, http.StatusUnauthorized, codeUnauthorized, "Not authenticated")
+            loggerFrom(c).Warn("Not authenticated")
+            return
+        }
+
+        conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+        if err != nil {
+            loggerFrom(c).Warn("Failed to upgrade WebSocket: " + err.Error())
+            return
+        }
+        defer conn.Close()
+
+        // Wait for the client to say which recipient it wants
+        var subscription wsSubscription
+        err = conn.ReadJSON(&subscription)
+        subscription.Recipient = normalizeName(subscription.Recipient)
+        if err != nil || subscription.Recipient == "" {
+            conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "recipient is required"))
+            loggerFrom(c).Warn("Invalid WebSocket subscription")
+            return
+        }
+        if subscription.Recipient != user {
+            conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "recipient must match the authenticated user"))
+            loggerFrom(c).Warn("User " + user + " attempted to subscribe to " + subscription.Recipient)
+            return
+        }
+
+        client := &wsClient{recipient: subscription.Recipient, send: make(chan Message, wsSendBuffer)}
+        hub.register(client)
+        defer hub.unregister(client)
+        loggerFrom(c).Info("WebSocket subscribed: " + client.recipient)
+
+        // Read until the client goes away so disconnects are noticed
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            for {
+                if _, _, err := conn.ReadMessage(); err != nil {
+                    return
+                }
+            }
+        }()
+
+        for {
+            select {
+            case <-done:
+                loggerFrom(c).Info("WebSocket disconnected: " + client.recipient)
+                return
+            case message := <-client.send:
+                conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+                if err := conn.WriteJSON(message); err != nil {
+                    loggerFrom(c).Warn("Failed to write to WebSocket: " + err.Error())
+                    return
+                }
+            }
+        }
+    }
+}